@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDisabledAccount(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	adminFor(t, s, "boss")
+	u, _ := s.CreateUser(ctx, "troll", "password")
+	p, _ := s.AddPost(ctx, *u, "hidden once suspended", nil)
+	_, secret, _ := s.CreateToken(ctx, *u, "bot")
+	session := loginCookies(t, handler, "troll", "password")
+
+	boss, _ := s.GetUser(ctx, "boss")
+	if err := s.SetDisabled(ctx, *boss, *u, true); err != nil {
+		t.Fatalf("SetDisabled failed: %v", err)
+	}
+
+	resp := formRequest(handler, "/login/", url.Values{"username": {"troll"}, "password": {"password"}}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a disabled login to get 403, got %d", resp.StatusCode)
+	}
+	if _, err := s.Login(ctx, "troll", "wrong", "10.0.0.1"); !errors.Is(err, errBadLogin) {
+		t.Errorf("expected a wrong password to say nothing about the account, got %v", err)
+	}
+	req := newAPIRequest("POST", "/api/v1/posts/", `{"body": "from a bot"}`)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if rr := serve(handler, req); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token to stop working, got %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", session); rr.Code != http.StatusFound {
+		t.Errorf("expected the existing session to be logged out, got %d", rr.Code)
+	}
+
+	for _, path := range []string{"/u/troll/", p.URL(), "/api/v1/users/troll/"} {
+		if rr := apiRequest(handler, "GET", path, "", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404, got %d", path, rr.Code)
+		}
+	}
+	for _, path := range []string{"/", "/search/?q=suspended", "/api/v1/posts/"} {
+		rr := apiRequest(handler, "GET", path, "", nil)
+		if strings.Contains(rr.Body.String(), "hidden once suspended") {
+			t.Errorf("GET %s: a disabled user's post is still listed", path)
+		}
+	}
+
+	// everything comes back when they're enabled again
+	s.SetDisabled(ctx, *boss, *u, false)
+	if rr := apiRequest(handler, "GET", "/", "", nil); !strings.Contains(rr.Body.String(), "hidden once suspended") {
+		t.Error("expected the post back after enabling the account")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	u, _ := s.CreateUser(ctx, "leaving", "password")
+	channels, _ := s.AddChannels(ctx, *u, []string{"mine"})
+	s.AddPost(ctx, *u, "goodbye world", channels)
+	s.CreateToken(ctx, *u, "bot")
+	other, _ := s.CreateUser(ctx, "staying", "password")
+	s.AddPost(ctx, *other, "still here", nil)
+	cookies := loginCookies(t, handler, "leaving", "password")
+
+	if rr := apiRequest(handler, "GET", "/settings/delete/", "", cookies); rr.Code != http.StatusOK {
+		t.Errorf("expected the confirmation page, got %d", rr.Code)
+	}
+	for _, form := range []url.Values{
+		{"password": {"wrong"}, "confirm": {"leaving"}},
+		{"password": {"password"}, "confirm": {"Leaving"}},
+	} {
+		resp := formRequest(handler, "/settings/delete/", form, cookies)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", resp.StatusCode)
+		}
+	}
+	if _, err := s.GetUser(ctx, "leaving"); err != nil {
+		t.Fatalf("expected the account to survive a failed confirmation, got %v", err)
+	}
+
+	resp := formRequest(handler, "/settings/delete/", url.Values{"password": {"password"}, "confirm": {"leaving"}}, cookies)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect after deleting, got %d", resp.StatusCode)
+	}
+	if _, err := s.GetUser(ctx, "leaving"); !errors.Is(err, errNotFound) {
+		t.Errorf("expected the user to be gone, got %v", err)
+	}
+	for table, want := range map[string]int{"post": 1, "post_fts": 1, "channel": 0, "postchannel": 0, "api_token": 0} {
+		if n := countRows(t, s.p, table); n != want {
+			t.Errorf("expected %d rows in %s, found %d", want, table, n)
+		}
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", resp.Cookies()); rr.Code != http.StatusFound {
+		t.Errorf("expected to be logged out, got %d", rr.Code)
+	}
+}
+
+func TestDeleteUserRollsBack(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	u, _ := p.CreateUser(ctx, "atomic", "password")
+	channels, _ := p.AddChannels(ctx, *u, []string{"one"})
+	p.AddPost(ctx, *u, "kept after all", channels)
+
+	// the last step fails after the posts and channels went
+	_, err := p.Database.Exec(`CREATE TRIGGER fail_users BEFORE DELETE ON users
+        BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+	if err != nil {
+		t.Fatalf("creating trigger failed: %v", err)
+	}
+	err = p.DeleteUser(ctx, u)
+	p.Database.Exec(`DROP TRIGGER fail_users`)
+	if err == nil {
+		t.Fatal("expected DeleteUser to fail")
+	}
+	for _, table := range []string{"users", "post", "post_fts", "channel", "postchannel"} {
+		if n := countRows(t, p, table); n != 1 {
+			t.Errorf("expected %s to be rolled back, found %d rows", table, n)
+		}
+	}
+}
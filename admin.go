@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// how much of each list the dashboard shows
+const (
+	adminUsers    = 100
+	adminPosts    = 25
+	adminChannels = 50
+)
+
+type adminResponse struct {
+	Users        []*user
+	Posts        []*post
+	Channels     []*channel
+	Registration registrationMode
+	Modes        []registrationMode
+	// only set right after an admin makes a reset link
+	ResetFor  string
+	ResetLink string
+	Message   string
+	Error     string
+	siteResponse
+}
+
+func (ar *adminResponse) load(r *http.Request, s *site) error {
+	var err error
+	if ar.Users, err = s.GetUsers(r.Context(), adminUsers, 0); err != nil {
+		return err
+	}
+	if ar.Posts, err = s.GetAllPosts(r.Context(), adminPosts, 0); err != nil {
+		return err
+	}
+	if ar.Channels, err = s.GetRecentChannels(r.Context(), adminChannels); err != nil {
+		return err
+	}
+	ar.Registration = s.Registration()
+	ar.Modes = []registrationMode{registrationOpen, registrationInvite, registrationClosed}
+	return nil
+}
+
+// adminContext is the site context for an admin page, or false if
+// the request has already been answered because it isn't an admin
+func adminContext(s *site, w http.ResponseWriter, r *http.Request) (siteContext, bool) {
+	ctx := siteContext{Site: s}
+	ctx.Populate(r)
+	if ctx.User == nil {
+		http.Redirect(w, r, "/login/", http.StatusFound)
+		return ctx, false
+	}
+	if !ctx.User.IsAdmin {
+		renderError(w, ctx, forbidden("admins only"))
+		return ctx, false
+	}
+	return ctx, true
+}
+
+func adminHandler(s *site) http.Handler {
+	tmpl := getTemplate("admin.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx, ok := adminContext(s, w, r)
+			if !ok {
+				return
+			}
+			ar := adminResponse{}
+			ctx.PopulateResponse(&ar)
+			if err := ar.load(r, s); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			render(w, ctx, tmpl, http.StatusOK, ar)
+		})
+}
+
+// adminFormHandler handles the dashboard's forms, which show the
+// dashboard again with how it went
+func adminFormHandler(s *site, action func(*http.Request, user, *adminResponse) error) http.Handler {
+	tmpl := getTemplate("admin.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx, ok := adminContext(s, w, r)
+			if !ok {
+				return
+			}
+			ar := adminResponse{}
+			status := http.StatusOK
+			err := action(r, *ctx.User, &ar)
+			switch {
+			case errors.Is(err, errValidation):
+				ar.Error = errorMessage(err)
+				status = http.StatusUnprocessableEntity
+			case err != nil:
+				renderError(w, ctx, err)
+				return
+			}
+			ctx.PopulateResponse(&ar)
+			if err := ar.load(r, s); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			render(w, ctx, tmpl, status, ar)
+		})
+}
+
+func adminDisableHandler(s *site, disabled bool) http.Handler {
+	return adminFormHandler(s, func(r *http.Request, admin user, ar *adminResponse) error {
+		u, err := s.GetUser(r.Context(), r.PathValue("username"))
+		if err != nil {
+			return err
+		}
+		if err := s.SetDisabled(r.Context(), admin, *u, disabled); err != nil {
+			return err
+		}
+		if disabled {
+			ar.Message = u.Username + " is disabled"
+		} else {
+			ar.Message = u.Username + " is enabled again"
+		}
+		return nil
+	})
+}
+
+func adminResetHandler(s *site) http.Handler {
+	return adminFormHandler(s, func(r *http.Request, _ user, ar *adminResponse) error {
+		u, err := s.GetUser(r.Context(), r.PathValue("username"))
+		if err != nil {
+			return err
+		}
+		link, err := s.CreateResetLink(r.Context(), *u)
+		if err != nil {
+			return err
+		}
+		ar.ResetFor, ar.ResetLink = u.Username, link
+		return nil
+	})
+}
+
+func adminRegistrationHandler(s *site) http.Handler {
+	return adminFormHandler(s, func(r *http.Request, _ user, ar *adminResponse) error {
+		mode := registrationMode(r.FormValue("mode"))
+		if err := s.SetRegistration(r.Context(), mode); err != nil {
+			return err
+		}
+		ar.Message = "registration is now " + string(mode)
+		return nil
+	})
+}
+
+// runMakeAdmin is the make-admin command. the first admin has to
+// come from somewhere.
+func runMakeAdmin(ctx context.Context, s *site, args []string, stdout io.Writer) error {
+	admin := true
+	if len(args) == 2 && args[0] == "-revoke" {
+		admin = false
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return errors.New("usage: finch make-admin [-revoke] <username>")
+	}
+	u, err := s.GetUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := s.SetAdmin(ctx, *u, admin); err != nil {
+		return err
+	}
+	if admin {
+		fmt.Fprintf(stdout, "%s is now an admin\n", u.Username)
+	} else {
+		fmt.Fprintf(stdout, "%s is no longer an admin\n", u.Username)
+	}
+	return nil
+}
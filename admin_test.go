@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// adminFor makes a user and promotes them the way the make-admin
+// command does
+func adminFor(t *testing.T, s *site, username string) {
+	t.Helper()
+	s.CreateUser(context.Background(), username, "password")
+	var out strings.Builder
+	if err := runMakeAdmin(context.Background(), s, []string{username}, &out); err != nil {
+		t.Fatalf("make-admin failed: %v", err)
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	adminFor(t, s, "boss")
+	u, _ := s.CreateUser(ctx, "regular", "password")
+	s.AddPost(ctx, *u, "a post to moderate", nil)
+
+	regular := loginCookies(t, handler, "regular", "password")
+	if rr := apiRequest(handler, "GET", "/admin/", "", regular); rr.Code != http.StatusForbidden {
+		t.Errorf("expected non admins to be kept out, got %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/admin/", "", nil); rr.Code != http.StatusFound {
+		t.Errorf("expected anonymous users to be sent to log in, got %d", rr.Code)
+	}
+	resp := formRequest(handler, "/admin/registration/", url.Values{"mode": {"closed"}}, regular)
+	if resp.StatusCode != http.StatusForbidden || s.Registration() != registrationOpen {
+		t.Errorf("a non admin changed the registration mode: %d", resp.StatusCode)
+	}
+
+	boss := loginCookies(t, handler, "boss", "password")
+	rr := apiRequest(handler, "GET", "/admin/", "", boss)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the dashboard, got %d", rr.Code)
+	}
+	for _, want := range []string{"regular", "a post to moderate", `value="invite"`} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("expected %q on the dashboard", want)
+		}
+	}
+}
+
+func TestAdminModeration(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	adminFor(t, s, "boss")
+	u, _ := s.CreateUser(ctx, "troll", "password")
+	channels, _ := s.AddChannels(ctx, *u, []string{"spam"})
+	p, _ := s.AddPost(ctx, *u, "buy my stuff", channels)
+	boss := loginCookies(t, handler, "boss", "password")
+
+	// admins can delete anyone's posts and channels
+	if resp := formRequest(handler, p.URL()+"delete/", url.Values{}, boss); resp.StatusCode != http.StatusFound {
+		t.Errorf("expected the admin to delete the post, got %d", resp.StatusCode)
+	}
+	if _, err := s.GetPostByUUID(ctx, p.UUID); !errors.Is(err, errNotFound) {
+		t.Errorf("expected the post to be gone, got %v", err)
+	}
+	if resp := formRequest(handler, "/u/troll/c/spam/delete/", url.Values{}, boss); resp.StatusCode != http.StatusFound {
+		t.Errorf("expected the admin to delete the channel, got %d", resp.StatusCode)
+	}
+
+	if resp := formRequest(handler, "/admin/users/troll/disable/", url.Values{}, boss); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected to disable the user, got %d", resp.StatusCode)
+	}
+	if u, _ := s.GetUser(ctx, "troll"); !u.Disabled {
+		t.Error("expected troll to be disabled")
+	}
+	if resp := formRequest(handler, "/admin/users/boss/disable/", url.Values{}, boss); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected admins to not be able to disable themselves, got %d", resp.StatusCode)
+	}
+	formRequest(handler, "/admin/users/troll/enable/", url.Values{}, boss)
+	if u, _ := s.GetUser(ctx, "troll"); u.Disabled {
+		t.Error("expected troll to be enabled again")
+	}
+
+	resp := formRequest(handler, "/admin/users/troll/reset/", url.Values{}, boss)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), s.BaseURL+"/reset/") {
+		t.Error("expected a reset link on the dashboard")
+	}
+}
+
+func TestRegistrationModeAtRuntime(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	adminFor(t, s, "boss")
+	boss := loginCookies(t, handler, "boss", "password")
+
+	if resp := formRequest(handler, "/admin/registration/", url.Values{"mode": {"sometimes"}}, boss); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected an unknown mode to be refused, got %d", resp.StatusCode)
+	}
+	if resp := formRequest(handler, "/admin/registration/", url.Values{"mode": {"closed"}}, boss); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the mode to change, got %d", resp.StatusCode)
+	}
+	if rr := apiRequest(handler, "GET", "/register/", "", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("expected registration to be closed, got %d", rr.Code)
+	}
+
+	// the setting outlasts a restart, whatever the environment says
+	restarted := newSite(s.p, s.BaseURL, s.Store, "10", "true")
+	if err := restarted.LoadSettings(ctx); err != nil {
+		t.Fatalf("LoadSettings failed: %v", err)
+	}
+	if restarted.Registration() != registrationClosed {
+		t.Errorf("expected the saved mode to win, got %s", restarted.Registration())
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maximum size of a JSON request body
+const apiMaxBodySize = 1 << 20
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type apiUser struct {
+	Username string `json:"username"`
+	URL      string `json:"url"`
+}
+
+type apiChannel struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Slug     string `json:"slug"`
+	Label    string `json:"label"`
+	URL      string `json:"url"`
+}
+
+type apiPost struct {
+	UUID     string       `json:"uuid"`
+	Username string       `json:"username"`
+	Body     string       `json:"body"`
+	HTML     string       `json:"html"`
+	Posted   time.Time    `json:"posted"`
+	URL      string       `json:"url"`
+	Channels []apiChannel `json:"channels"`
+	// highlighted HTML excerpt, only on search results
+	Snippet string `json:"snippet,omitempty"`
+}
+
+type apiPagination struct {
+	Page        int  `json:"page"`
+	PerPage     int  `json:"per_page"`
+	HasPrevPage bool `json:"has_prev_page"`
+	HasNextPage bool `json:"has_next_page"`
+}
+
+type apiPostsResponse struct {
+	Posts []apiPost `json:"posts"`
+	apiPagination
+}
+
+func newAPIUser(u *user) apiUser {
+	return apiUser{Username: u.Username, URL: "/u/" + u.Username + "/"}
+}
+
+func newAPIChannel(c *channel) apiChannel {
+	ac := apiChannel{ID: c.ID, Slug: c.Slug, Label: c.Label}
+	if c.User != nil {
+		ac.Username = c.User.Username
+		ac.URL = "/u/" + c.User.Username + "/c/" + c.Slug + "/"
+	}
+	return ac
+}
+
+func newAPIChannels(channels []*channel) []apiChannel {
+	out := make([]apiChannel, 0, len(channels))
+	for _, c := range channels {
+		out = append(out, newAPIChannel(c))
+	}
+	return out
+}
+
+func newAPIPost(p *post) apiPost {
+	ap := apiPost{
+		UUID:     p.UUID,
+		Username: p.User.Username,
+		Body:     p.Body,
+		HTML:     string(p.RenderBody()),
+		Posted:   p.Time().UTC(),
+		URL:      p.URL(),
+		Channels: newAPIChannels(p.Channels),
+	}
+	if p.Snippet != "" {
+		ap.Snippet = string(p.RenderSnippet())
+	}
+	return ap
+}
+
+func newAPIPosts(posts []*post, page, perPage int) apiPostsResponse {
+	out := make([]apiPost, 0, len(posts))
+	for _, p := range posts {
+		out = append(out, newAPIPost(p))
+	}
+	return apiPostsResponse{
+		Posts: out,
+		apiPagination: apiPagination{
+			Page:        page,
+			PerPage:     perPage,
+			HasPrevPage: page > 0,
+			// same caveat as the HTML pagination: a full page
+			// might be followed by an empty one
+			HasNextPage: len(posts) == perPage,
+		},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error encoding json response", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiErrorResponse{Error: msg})
+}
+
+// writeJSONSiteError reports an error that came back from the
+// site with the status and message its kind calls for
+func writeJSONSiteError(w http.ResponseWriter, err error) {
+	status := errorStatus(err)
+	if status >= 500 {
+		log.Println(err)
+	}
+	writeJSONError(w, status, errorMessage(err))
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiPage returns the zero-indexed page requested
+func apiPage(r *http.Request) (int, bool) {
+	spage := r.URL.Query().Get("page")
+	if spage == "" {
+		return 0, true
+	}
+	page, err := strconv.Atoi(spage)
+	if err != nil || page < 0 {
+		return 0, false
+	}
+	return page, true
+}
+
+// apiAuthenticate fills in the context and makes sure
+// there is a user attached to the request
+func apiAuthenticate(w http.ResponseWriter, r *http.Request, ctx *siteContext) bool {
+	ctx.Populate(r)
+	if ctx.User == nil {
+		writeJSONError(w, http.StatusUnauthorized, "authentication required")
+		return false
+	}
+	return true
+}
+
+func apiAllPosts(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			page, ok := apiPage(r)
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, "invalid page")
+				return
+			}
+			posts, err := s.GetAllPosts(r.Context(), s.ItemsPerPage, page*s.ItemsPerPage)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIPosts(posts, page, s.ItemsPerPage))
+		})
+}
+
+func apiSearch(s *site) http.Handler {
+	type searchResponse struct {
+		Q string `json:"q"`
+		apiPostsResponse
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query().Get("q")
+			query, err := parseSearchQuery(q)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if query.Empty() {
+				writeJSONError(w, http.StatusBadRequest, "missing q parameter")
+				return
+			}
+			page, ok := apiPage(r)
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, "invalid page")
+				return
+			}
+			posts, err := s.SearchPosts(r.Context(), query, s.ItemsPerPage, page*s.ItemsPerPage)
+			if errors.Is(err, errInvalidSearch) {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, searchResponse{
+				Q:                q,
+				apiPostsResponse: newAPIPosts(posts, page, s.ItemsPerPage),
+			})
+		})
+}
+
+// apiResolveChannels maps channel labels to the user's channels.
+// ones that don't exist yet are created when the post is saved.
+func apiResolveChannels(ctx context.Context, s *site, u user, labels []string) ([]*channel, error) {
+	existing, err := s.GetUserChannels(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	bySlug := make(map[string]*channel)
+	for _, c := range existing {
+		bySlug[c.Slug] = c
+	}
+	var channels []*channel
+	for _, label := range labels {
+		if label == "" {
+			continue
+		}
+		c, ok := bySlug[slugify(label)]
+		if !ok {
+			c = newChannel(u, label)
+			bySlug[c.Slug] = c
+		}
+		channels = append(channels, c)
+	}
+	return channels, nil
+}
+
+func apiAddPost(s *site) http.Handler {
+	type addPostRequest struct {
+		Body string `json:"body"`
+		// labels of channels to post in. any that the
+		// user doesn't have yet are created
+		Channels []string `json:"channels"`
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			if !apiAuthenticate(w, r, &ctx) {
+				return
+			}
+			var req addPostRequest
+			if !readJSON(w, r, &req) {
+				return
+			}
+			if req.Body == "" {
+				writeJSONError(w, http.StatusUnprocessableEntity, "body is required")
+				return
+			}
+			channels, err := apiResolveChannels(r.Context(), s, *ctx.User, req.Channels)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			p, err := s.AddPost(r.Context(), *ctx.User, req.Body, channels)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			p.Channels, err = s.GetPostChannels(r.Context(), p)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			w.Header().Set("Location", "/api/v1/posts/"+p.UUID+"/")
+			writeJSON(w, http.StatusCreated, newAPIPost(p))
+		})
+}
+
+func apiGetPost(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			p, err := s.GetVisiblePost(r.Context(), r.PathValue("puuid"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			p.Channels, err = s.GetPostChannels(r.Context(), p)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIPost(p))
+		})
+}
+
+func apiUpdatePost(s *site) http.Handler {
+	type updatePostRequest struct {
+		Body     string   `json:"body"`
+		Channels []string `json:"channels"`
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			if !apiAuthenticate(w, r, &ctx) {
+				return
+			}
+			p, err := s.GetPostByUUID(r.Context(), r.PathValue("puuid"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			if ctx.User.ID != p.User.ID {
+				writeJSONError(w, http.StatusForbidden, "you can only edit your own posts")
+				return
+			}
+			var req updatePostRequest
+			if !readJSON(w, r, &req) {
+				return
+			}
+			if req.Body == "" {
+				writeJSONError(w, http.StatusUnprocessableEntity, "body is required")
+				return
+			}
+			channels, err := apiResolveChannels(r.Context(), s, *ctx.User, req.Channels)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			p, err = s.UpdatePost(r.Context(), p, req.Body, channels)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			p.Channels, err = s.GetPostChannels(r.Context(), p)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIPost(p))
+		})
+}
+
+func apiPostRevisions(s *site) http.Handler {
+	type apiRevision struct {
+		Body   string    `json:"body"`
+		Edited time.Time `json:"edited"`
+	}
+	type revisionsResponse struct {
+		Revisions []apiRevision `json:"revisions"`
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			p, err := s.GetVisiblePost(r.Context(), r.PathValue("puuid"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			revisions, err := s.GetPostRevisions(r.Context(), p)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			out := make([]apiRevision, 0, len(revisions))
+			for _, rev := range revisions {
+				out = append(out, apiRevision{Body: rev.Body, Edited: rev.Time().UTC()})
+			}
+			writeJSON(w, http.StatusOK, revisionsResponse{Revisions: out})
+		})
+}
+
+func apiDeletePost(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			if !apiAuthenticate(w, r, &ctx) {
+				return
+			}
+			p, err := s.GetPostByUUID(r.Context(), r.PathValue("puuid"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			if !ctx.User.CanDelete(p.User) {
+				writeJSONError(w, http.StatusForbidden, "you can only delete your own posts")
+				return
+			}
+			if err := s.DeletePost(r.Context(), p); err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+}
+
+func apiGetUser(s *site) http.Handler {
+	type userResponse struct {
+		apiUser
+		Channels []apiChannel `json:"channels"`
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u, err := s.GetVisibleUser(r.Context(), r.PathValue("username"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			channels, err := s.GetUserChannels(r.Context(), *u)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			for _, c := range channels {
+				c.User = u
+			}
+			writeJSON(w, http.StatusOK, userResponse{
+				apiUser:  newAPIUser(u),
+				Channels: newAPIChannels(channels),
+			})
+		})
+}
+
+func apiUserPosts(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u, err := s.GetVisibleUser(r.Context(), r.PathValue("username"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			page, ok := apiPage(r)
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, "invalid page")
+				return
+			}
+			posts, err := s.GetAllUserPosts(r.Context(), u, s.ItemsPerPage, page*s.ItemsPerPage)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIPosts(posts, page, s.ItemsPerPage))
+		})
+}
+
+func apiUserChannels(s *site) http.Handler {
+	type channelsResponse struct {
+		Channels []apiChannel `json:"channels"`
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u, err := s.GetVisibleUser(r.Context(), r.PathValue("username"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			channels, err := s.GetUserChannels(r.Context(), *u)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			for _, c := range channels {
+				c.User = u
+			}
+			writeJSON(w, http.StatusOK, channelsResponse{Channels: newAPIChannels(channels)})
+		})
+}
+
+func apiAddChannels(s *site) http.Handler {
+	type addChannelsRequest struct {
+		Labels []string `json:"labels"`
+	}
+	type channelsResponse struct {
+		Channels []apiChannel `json:"channels"`
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			if !apiAuthenticate(w, r, &ctx) {
+				return
+			}
+			var req addChannelsRequest
+			if !readJSON(w, r, &req) {
+				return
+			}
+			existing, err := s.GetUserChannels(r.Context(), *ctx.User)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			taken := make(map[string]bool)
+			for _, c := range existing {
+				taken[c.Slug] = true
+			}
+			var names []string
+			for _, label := range req.Labels {
+				if label == "" {
+					continue
+				}
+				if taken[slugify(label)] {
+					writeJSONError(w, http.StatusConflict, "channel "+label+" already exists")
+					return
+				}
+				taken[slugify(label)] = true
+				names = append(names, label)
+			}
+			if len(names) == 0 {
+				writeJSONError(w, http.StatusUnprocessableEntity, "labels are required")
+				return
+			}
+			created, err := s.AddChannels(r.Context(), *ctx.User, names)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, channelsResponse{Channels: newAPIChannels(created)})
+		})
+}
+
+func apiGetChannel(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u, err := s.GetVisibleUser(r.Context(), r.PathValue("username"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			c, err := s.GetChannel(r.Context(), *u, r.PathValue("slug"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIChannel(c))
+		})
+}
+
+func apiChannelPosts(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u, err := s.GetVisibleUser(r.Context(), r.PathValue("username"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			c, err := s.GetChannel(r.Context(), *u, r.PathValue("slug"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			page, ok := apiPage(r)
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, "invalid page")
+				return
+			}
+			posts, err := s.GetAllPostsInChannel(r.Context(), *c, s.ItemsPerPage, page*s.ItemsPerPage)
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, newAPIPosts(posts, page, s.ItemsPerPage))
+		})
+}
+
+func apiDeleteChannel(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			if !apiAuthenticate(w, r, &ctx) {
+				return
+			}
+			u, err := s.GetUser(r.Context(), r.PathValue("username"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			c, err := s.GetChannel(r.Context(), *u, r.PathValue("slug"))
+			if err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			if !ctx.User.CanDelete(c.User) {
+				writeJSONError(w, http.StatusForbidden, "you can only delete your own channels")
+				return
+			}
+			if err := s.DeleteChannel(r.Context(), c); err != nil {
+				writeJSONSiteError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+}
+
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "no such endpoint")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupAPIServer(t *testing.T) (*site, http.Handler, func()) {
+	p, cleanup := setupTestDB(t)
+	s := newSite(p, "http://localhost", nil, "10", "true")
+	s.Store = newSessionStore(s, []byte("secret"))
+	handler := NewServer("templates", "media", s, p)
+	return s, handler, cleanup
+}
+
+var csrfInput = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+
+// csrfFor fetches the login form to get the CSRF token for a
+// session, starting a new one if there are no cookies yet
+func csrfFor(handler http.Handler, cookies []*http.Cookie) (string, []*http.Cookie) {
+	req := httptest.NewRequest("GET", "/login/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := serve(handler, req)
+	if fresh := rr.Result().Cookies(); len(fresh) > 0 {
+		cookies = fresh
+	}
+	m := csrfInput.FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		return "", cookies
+	}
+	return m[1], cookies
+}
+
+// loginCookies logs in through the regular form and returns the
+// session cookies to attach to subsequent requests
+func loginCookies(t *testing.T, handler http.Handler, username, password string) []*http.Cookie {
+	token, cookies := csrfFor(handler, nil)
+	form := url.Values{"username": {username}, "password": {password}, csrfField: {token}}
+	req := httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("login failed: %d %s", rr.Code, rr.Body.String())
+	}
+	return rr.Result().Cookies()
+}
+
+func newAPIRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+func serve(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// apiRequest makes a request with the session cookies, if any,
+// sending the CSRF header the way a browser script would
+func apiRequest(handler http.Handler, method, path, body string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := newAPIRequest(method, path, body)
+	if len(cookies) > 0 && !isSafeMethod(method) {
+		var token string
+		token, cookies = csrfFor(handler, cookies)
+		req.Header.Set(csrfHeader, token)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return serve(handler, req)
+}
+
+func TestAPIPosts(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	if _, err := s.CreateUser(context.Background(), "apiuser", "apipass"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	// writes need authentication
+	rr := apiRequest(handler, "POST", "/api/v1/posts/", `{"body": "hi"}`, nil)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	var apiErr apiErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &apiErr); err != nil || apiErr.Error == "" {
+		t.Errorf("expected JSON error body, got %q", rr.Body.String())
+	}
+
+	cookies := loginCookies(t, handler, "apiuser", "apipass")
+
+	rr = apiRequest(handler, "POST", "/api/v1/posts/", `{"body": "hello **api**", "channels": ["Scripts"]}`, cookies)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created apiPost
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if created.Username != "apiuser" || created.UUID == "" {
+		t.Errorf("unexpected post %+v", created)
+	}
+	if len(created.Channels) != 1 || created.Channels[0].Slug != "scripts" {
+		t.Errorf("expected the scripts channel, got %+v", created.Channels)
+	}
+
+	rr = apiRequest(handler, "POST", "/api/v1/posts/", `{"body": "again", "channels": ["scripts"]}`, cookies)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	channels, _ := s.GetUserChannels(context.Background(), apiUserFor(t, s, "apiuser"))
+	if len(channels) != 1 {
+		t.Errorf("existing channel should have been reused, have %d channels", len(channels))
+	}
+
+	rr = apiRequest(handler, "GET", "/api/v1/posts/", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var list apiPostsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if len(list.Posts) != 2 {
+		t.Errorf("expected 2 posts, got %d", len(list.Posts))
+	}
+
+	rr = apiRequest(handler, "GET", "/api/v1/users/apiuser/channels/scripts/posts/", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	rr = apiRequest(handler, "GET", "/api/v1/search/?q=api", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	rr = apiRequest(handler, "GET", "/api/v1/posts/"+created.UUID+"/", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	rr = apiRequest(handler, "DELETE", "/api/v1/posts/"+created.UUID+"/", "", cookies)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+
+	rr = apiRequest(handler, "GET", "/api/v1/posts/"+created.UUID+"/", "", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rr.Code)
+	}
+}
+
+func TestRejectedPostLeavesNoChannels(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "poster", "password")
+	cookies := loginCookies(t, handler, "poster", "password")
+	huge := strings.Repeat("x", maxPostBody+1)
+
+	for _, body := range []string{"  ", huge} {
+		resp := formRequest(handler, "/post/", url.Values{"body": {body}, "new_channel0": {"form channel"}}, cookies)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("form post: expected 422, got %d", resp.StatusCode)
+		}
+		js, _ := json.Marshal(map[string]interface{}{"body": body, "channels": []string{"api channel"}})
+		if rr := apiRequest(handler, "POST", "/api/v1/posts/", string(js), cookies); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("api post: expected 422, got %d", rr.Code)
+		}
+	}
+
+	u := apiUserFor(t, s, "poster")
+	p, _ := s.AddPost(context.Background(), u, "fine", nil)
+	js, _ := json.Marshal(map[string]interface{}{"body": huge, "channels": []string{"edit channel"}})
+	if rr := apiRequest(handler, "PUT", "/api/v1/posts/"+p.UUID+"/", string(js), cookies); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("api update: expected 422, got %d", rr.Code)
+	}
+
+	if n := countRows(t, s.p, "channel"); n != 0 {
+		t.Errorf("expected rejected posts to leave no channels, found %d", n)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/api/v1/users/nobody/", http.StatusNotFound},
+		{"GET", "/api/v1/users/nobody/posts/", http.StatusNotFound},
+		{"GET", "/api/v1/posts/?page=-1", http.StatusBadRequest},
+		{"GET", "/api/v1/search/", http.StatusBadRequest},
+		{"GET", "/api/v1/nothing/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rr := apiRequest(handler, tt.method, tt.path, "", nil)
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.status, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s %s: expected JSON, got %q", tt.method, tt.path, ct)
+		}
+	}
+}
+
+func apiUserFor(t *testing.T, s *site, username string) user {
+	u, err := s.GetUser(context.Background(), username)
+	if err != nil {
+		t.Fatalf("GetUser failed: %v", err)
+	}
+	return *u
+}
+
+func TestTimeoutsReturn503(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	// every operation is already past its deadline
+	s.OpTimeout = time.Nanosecond
+
+	for _, path := range []string{"/", "/u/nobody/", "/api/v1/posts/", "/api/v1/users/nobody/"} {
+		rr := apiRequest(handler, "GET", path, "", nil)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("GET %s: expected 503, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestPostBodiesAreSanitizedEverywhere(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	u, _ := s.CreateUser(ctx, "mallory", "password")
+	channels, _ := s.AddChannels(ctx, *u, []string{"traps"})
+	p, _ := s.AddPost(ctx, *u, "hello <script>steal('cookies')</script> <img src=x onerror=\"steal('more')\">", channels)
+
+	for _, path := range []string{
+		"/", p.URL(), "/u/mallory/", "/u/mallory/c/traps/",
+		"/u/mallory/feed/", "/u/mallory/c/traps/feed/",
+		"/api/v1/posts/", "/api/v1/posts/" + p.UUID + "/",
+	} {
+		rr := apiRequest(handler, "GET", path, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", path, rr.Code)
+			continue
+		}
+		body := rr.Body.String()
+		if strings.Contains(path, "/api/") {
+			// the raw markdown is in the JSON as well; only the
+			// html has to be clean
+			var out struct {
+				HTML  string `json:"html"`
+				Posts []struct {
+					HTML string `json:"html"`
+				} `json:"posts"`
+			}
+			json.Unmarshal(rr.Body.Bytes(), &out)
+			body = out.HTML
+			for _, p := range out.Posts {
+				body += p.HTML
+			}
+		}
+		if !strings.Contains(body, "hello") {
+			t.Errorf("GET %s: expected the post to be there", path)
+		}
+		if strings.Contains(body, "steal") {
+			t.Errorf("GET %s: the script made it into the output", path)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// templates and media are built into the binary, so a deployment is
+// just the one file. FINCH_TEMPLATE_DIR and FINCH_MEDIA_DIR still
+// point at copies on disk for anyone who wants to change them.
+var (
+	//go:embed templates/*.html
+	embeddedTemplates embed.FS
+	//go:embed media
+	embeddedMedia embed.FS
+)
+
+var (
+	// where pages are parsed from
+	templateFS = assetFS("", embeddedTemplates, "templates")
+	// set by FINCH_DEV. templates are parsed again on every render
+	// instead of once at startup.
+	templateReload = false
+)
+
+// assetFS is dir if it's set, or else the embedded copy of sub
+func assetFS(dir string, embedded embed.FS, sub string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	fsys, err := fs.Sub(embedded, sub)
+	if err != nil {
+		panic(err) // only if the embed pattern above is wrong
+	}
+	return fsys
+}
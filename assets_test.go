@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedAssets(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	// no directories given, so everything comes from the binary
+	handler := NewServer("", "", s, s.p)
+
+	for _, path := range []string{"/", "/login/", "/media/css/style.css", "/media/feed.svg"} {
+		if rr := apiRequest(handler, "GET", path, "", nil); rr.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", path, rr.Code)
+		}
+	}
+	if rr := apiRequest(handler, "GET", "/media/nothing.css", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected a missing file to 404, got %d", rr.Code)
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("base.html", `<h1>{{ template "content" . }}</h1>`)
+	write("page.html", `{{ define "content" }}before{{ end }}`)
+
+	oldFS, oldReload := templateFS, templateReload
+	defer func() { templateFS, templateReload = oldFS, oldReload }()
+	templateFS = os.DirFS(dir)
+
+	render := func(p *page) string {
+		var out strings.Builder
+		if err := p.Execute(&out, nil); err != nil {
+			t.Fatalf("rendering failed: %v", err)
+		}
+		return out.String()
+	}
+
+	templateReload = false
+	parsedOnce := getTemplate("page.html")
+	templateReload = true
+	reloading := getTemplate("page.html")
+
+	write("page.html", `{{ define "content" }}after{{ end }}`)
+	if got := render(parsedOnce); got != "<h1>before</h1>" {
+		t.Errorf("expected the parsed copy to be kept, got %q", got)
+	}
+	if got := render(reloading); got != "<h1>after</h1>" {
+		t.Errorf("expected the edit to show up, got %q", got)
+	}
+}
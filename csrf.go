@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// every session gets a random token which forms send back in a
+// hidden field (and scripts in a header). a cross site request
+// carries the session cookie but has no way to read the token.
+const (
+	csrfField   = "csrf_token"
+	csrfHeader  = "X-CSRF-Token"
+	csrfSession = "csrf"
+)
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// csrfProtect makes sure the session has a token and rejects any
+// state changing request that doesn't send it back. the session is
+// cached for the request, so handlers see the token through
+// siteContext.Populate.
+func csrfProtect(s *site, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !csrfApplies(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sess, _ := s.Store.Get(r, "finch")
+		token, _ := sess.Values[csrfSession].(string)
+		if token == "" {
+			token = newCSRFToken()
+			sess.Values[csrfSession] = token
+			sess.Save(r, w)
+		}
+
+		if !isSafeMethod(r.Method) && csrfRequired(r) {
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = r.PostFormValue(csrfField)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				csrfFailure(w, r, s)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// csrfApplies is false for requests that never need a session:
+// health checks, static files and API calls with a bearer token
+func csrfApplies(r *http.Request) bool {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/healthz/"), strings.HasPrefix(r.URL.Path, "/media/"):
+		return false
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		_, ok := bearerToken(r)
+		return !ok
+	}
+	return true
+}
+
+// csrfRequired is false for requests that carry no ambient
+// credentials for a forged request to borrow: API calls with a
+// bearer token, or with no session cookie at all
+func csrfRequired(r *http.Request) bool {
+	if _, ok := bearerToken(r); ok {
+		return false
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		_, err := r.Cookie("finch")
+		return err == nil
+	}
+	return true
+}
+
+func csrfFailure(w http.ResponseWriter, r *http.Request, s *site) {
+	const msg = "invalid or missing CSRF token"
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSONError(w, http.StatusForbidden, msg)
+		return
+	}
+	errorPage(w, siteContext{Site: s, JSON: wantsJSON(r)}, http.StatusForbidden, msg)
+}
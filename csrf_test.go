@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postWithoutCSRF sends a form the way a cross site request would:
+// with the session cookie but without the token
+func postWithoutCSRF(handler http.Handler, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return serve(handler, req)
+}
+
+func TestCSRFProtection(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "victim", "password")
+	cookies := loginCookies(t, handler, "victim", "password")
+
+	forged := []string{"/post/", "/login/", "/register/", "/logout/", "/settings/tokens/"}
+	for _, path := range forged {
+		rr := postWithoutCSRF(handler, path, url.Values{"body": {"pwned"}}, cookies)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("POST %s without a token: expected 403, got %d", path, rr.Code)
+		}
+		rr = postWithoutCSRF(handler, path, url.Values{"body": {"pwned"}, csrfField: {"guess"}}, cookies)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("POST %s with the wrong token: expected 403, got %d", path, rr.Code)
+		}
+	}
+	if posts, _ := s.GetAllPosts(context.Background(), 10, 0); len(posts) != 0 {
+		t.Errorf("a forged post got through")
+	}
+
+	// the real form carries the token and works
+	token, _ := csrfFor(handler, cookies)
+	rr := apiRequest(handler, "GET", "/post/", "", cookies)
+	if !strings.Contains(rr.Body.String(), `value="`+token+`"`) {
+		t.Error("the post form doesn't include the CSRF token")
+	}
+	resp := formRequest(handler, "/post/", url.Values{"body": {"legit"}}, cookies)
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected a post with the token to redirect, got %d", resp.StatusCode)
+	}
+
+	// cookie authenticated API calls need the header, token
+	// authenticated ones don't
+	req := newAPIRequest("POST", "/api/v1/posts/", `{"body": "forged"}`)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	if rr := serve(handler, req); rr.Code != http.StatusForbidden {
+		t.Errorf("cookie API call without the header: expected 403, got %d", rr.Code)
+	}
+	u := apiUserFor(t, s, "victim")
+	_, secret, _ := s.CreateToken(context.Background(), u, "bot")
+	req = newAPIRequest("POST", "/api/v1/posts/", `{"body": "from a bot"}`)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if rr := serve(handler, req); rr.Code != http.StatusCreated {
+		t.Errorf("token API call: expected 201, got %d", rr.Code)
+	}
+}
+
+func TestLogoutIsPost(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "leaving", "password")
+	cookies := loginCookies(t, handler, "leaving", "password")
+
+	// a link or image pointing at /logout/ does nothing
+	apiRequest(handler, "GET", "/logout/", "", cookies)
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusOK {
+		t.Errorf("GET /logout/ logged the user out")
+	}
+	resp := formRequest(handler, "/logout/", url.Values{}, cookies)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected logout to redirect, got %d", resp.StatusCode)
+	}
+	rr := apiRequest(handler, "GET", "/settings/", "", resp.Cookies())
+	if rr.Code != http.StatusFound {
+		t.Errorf("expected to be logged out, got %d", rr.Code)
+	}
+}
@@ -19,6 +19,7 @@ buildGoApplication {
   pwd = ./.;
   src = ./.;
   modules = ./gomod2nix.toml;
+  tags = [ "sqlite_fts5" ];
   go = pkgs.go;
   GOTOOLCHAIN = "local";
 }
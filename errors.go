@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// every error that comes back out of the site is one of these
+// kinds. handlers pick the status code from the kind rather than
+// from whatever the database happened to say.
+var (
+	errNotFound   = errors.New("not found")
+	errConflict   = errors.New("conflict")
+	errValidation = errors.New("invalid")
+	errForbidden  = errors.New("forbidden")
+	errInternal   = errors.New("internal error")
+)
+
+// siteError is an error of one of the kinds above. Msg is meant
+// for users; Err is the underlying cause and only gets logged.
+// validation errors from forms may also say which field each
+// problem is with.
+type siteError struct {
+	Kind   error
+	Msg    string
+	Err    error
+	Fields map[string]string
+}
+
+func (e *siteError) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return e.Msg + ": " + e.Err.Error()
+}
+
+// Unwrap exposes both the kind and the cause, so errors.Is works
+// for errNotFound as well as, say, sql.ErrNoRows
+func (e *siteError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+func notFound(what string, err error) error {
+	return &siteError{Kind: errNotFound, Msg: what + " not found", Err: err}
+}
+
+func conflict(msg string, err error) error {
+	return &siteError{Kind: errConflict, Msg: msg, Err: err}
+}
+
+func invalid(msg string) error {
+	return &siteError{Kind: errValidation, Msg: msg}
+}
+
+func forbidden(msg string) error {
+	return &siteError{Kind: errForbidden, Msg: msg}
+}
+
+func internal(err error) error {
+	return &siteError{Kind: errInternal, Msg: "something went wrong", Err: err}
+}
+
+// lookupError turns a missing row into a not found error and
+// passes anything else through
+func lookupError(what string, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound(what, err)
+	}
+	return err
+}
+
+// errorStatus is the HTTP status for an error returned by the site
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTimeout):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errConflict):
+		return http.StatusConflict
+	case errors.Is(err, errValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// errorMessage is what the user gets told. internal errors are
+// deliberately vague; the details go to the log.
+func errorMessage(err error) string {
+	if errors.Is(err, errTimeout) {
+		return "the server is busy, please try again"
+	}
+	var se *siteError
+	if errors.As(err, &se) && se.Kind != errInternal {
+		return se.Msg
+	}
+	return "something went wrong"
+}
+
+// fieldErrors are the per field messages of a validation error, for
+// showing next to each field when a form is shown again
+func fieldErrors(err error) map[string]string {
+	var se *siteError
+	if errors.As(err, &se) {
+		return se.Fields
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestErrorKinds(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	u, _ := s.CreateUser(context.Background(), "kinds", "password")
+
+	_, err := s.GetUser(context.Background(), "nobody")
+	if !errors.Is(err, errNotFound) || !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected not found wrapping sql.ErrNoRows, got %v", err)
+	}
+	if errorStatus(err) != http.StatusNotFound || errorMessage(err) != "user not found" {
+		t.Errorf("got %d %q for a missing user", errorStatus(err), errorMessage(err))
+	}
+
+	_, err = s.AddPost(context.Background(), *u, "   ", nil)
+	if !errors.Is(err, errValidation) || errorStatus(err) != http.StatusUnprocessableEntity {
+		t.Errorf("expected a validation error for an empty post, got %v", err)
+	}
+
+	err = fmt.Errorf("wrapped: %w", conflict("username taken", nil))
+	if errorStatus(err) != http.StatusConflict || errorMessage(err) != "username taken" {
+		t.Errorf("got %d %q for a conflict", errorStatus(err), errorMessage(err))
+	}
+
+	s.p.Reader.Close()
+	_, err = s.GetAllPosts(context.Background(), 10, 0)
+	if !errors.Is(err, errInternal) {
+		t.Errorf("expected an internal error from a closed database, got %v", err)
+	}
+	if errorStatus(err) != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", errorStatus(err))
+	}
+	if msg := errorMessage(err); strings.Contains(msg, "closed") {
+		t.Errorf("internal details leaked into the message: %q", msg)
+	}
+}
+
+func TestServerSurvivesDatabaseFailures(t *testing.T) {
+	// a database of its own, since this one gets closed under
+	// the server
+	p, cleanup := setupFileDB(t)
+	defer cleanup()
+	s := newSite(p, "http://localhost", sessions.NewCookieStore([]byte("secret")), "10", "true")
+	handler := NewServer("templates", "media", s, p)
+	s.CreateUser(context.Background(), "survivor", "password")
+	cookies := loginCookies(t, handler, "survivor", "password")
+
+	// make every new post fail inside AddPost
+	_, err := s.p.Database.Exec(`CREATE TRIGGER fail_post BEFORE INSERT ON post
+        BEGIN SELECT RAISE(ABORT, 'disk on fire'); END`)
+	if err != nil {
+		t.Fatalf("creating trigger failed: %v", err)
+	}
+	defer s.p.Database.Exec(`DROP TRIGGER fail_post`)
+
+	resp := formRequest(handler, "/post/", url.Values{"body": {"doomed"}}, cookies)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected 500 when AddPost fails, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "something went wrong") || strings.Contains(string(body), "disk on fire") {
+		t.Errorf("expected the generic error page, got %q", body)
+	}
+
+	resp = formRequest(handler, "/post/", url.Values{"body": {""}}, cookies)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for an empty post, got %d", resp.StatusCode)
+	}
+
+	if rr := apiRequest(handler, "GET", "/", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("server unhealthy after a failed write: %d", rr.Code)
+	}
+
+	// with the database gone entirely every page should still answer
+	s.p.Database.Close()
+	s.p.Reader.Close()
+	for _, path := range []string{"/", "/u/survivor/", "/search/?q=hello", "/api/v1/posts/"} {
+		rr := apiRequest(handler, "GET", path, "", nil)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("GET %s: expected 500, got %d", path, rr.Code)
+		}
+	}
+	rr := apiRequest(handler, "GET", "/api/v1/users/survivor/", "", nil)
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("expected a JSON error from the API, got %q", ct)
+	}
+}
@@ -10,15 +10,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/braintree/manners"
-	"github.com/gorilla/sessions"
 )
 
-var templateDir = "templates"
-
 func LoggingHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		format := "%s - - [%s] \"%s %s %s\" %s\n"
@@ -43,7 +41,8 @@ func NewServer(
 		p,
 	)
 	var handler http.Handler = mux
-	handler = LoggingHandler(mux)
+	handler = csrfProtect(s, handler)
+	handler = LoggingHandler(handler)
 	return handler
 }
 
@@ -57,19 +56,62 @@ func run(ctx context.Context,
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
-	log.Println("Starting Finch...")
 	// set up the database file
-	p := newPersistence(getenv("FINCH_DB_FILE"))
+	p, err := newPersistence(getenv("FINCH_DB_FILE"))
+	if err != nil {
+		return err
+	}
 	defer p.Close()
-	templateDir = getenv("FINCH_TEMPLATE_DIR")
+
+	if len(args) > 1 && args[1] == "migrate" {
+		return runMigrate(ctx, p, args[2:], stdout)
+	}
+
+	log.Println("Starting Finch...")
+	if _, err := p.Migrate(ctx, false); err != nil {
+		return err
+	}
+	templateDir := getenv("FINCH_TEMPLATE_DIR")
 	mediaDir := getenv("FINCH_MEDIA_DIR")
+	templateReload, _ = strconv.ParseBool(getenv("FINCH_DEV"))
+	if templateReload && templateDir == "" {
+		// reloading the embedded copy would never see a change
+		templateDir = "templates"
+	}
+	templateFS = assetFS(templateDir, embeddedTemplates, "templates")
 	s := newSite(
 		p,
 		getenv("FINCH_BASE_URL"),
-		sessions.NewCookieStore([]byte(getenv("FINCH_SECRET"))),
+		nil,
 		getenv("FINCH_ITEMS_PER_PAGE"),
 		getenv("FINCH_ALLOW_REGISTRATION"),
 	)
+	if t := getenv("FINCH_DB_TIMEOUT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return fmt.Errorf("FINCH_DB_TIMEOUT: %w", err)
+		}
+		s.OpTimeout = d
+	}
+	s.ClientIPHeader = getenv("FINCH_CLIENT_IP_HEADER")
+	if err := s.LoadSettings(ctx); err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		switch args[1] {
+		case "reset-link":
+			return runResetLink(ctx, s, args[2:], stdout)
+		case "make-admin":
+			return runMakeAdmin(ctx, s, args[2:], stdout)
+		}
+	}
+	keys, err := sessionKeys(getenv)
+	if err != nil {
+		return err
+	}
+	// the store writes through the site, so it comes after it
+	s.Store = newSessionStore(s, keys...)
+	go cleanSessions(ctx, s, sessionCleanupInterval)
 	srv := NewServer(
 		templateDir,
 		mediaDir,
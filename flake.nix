@@ -30,10 +30,13 @@
               gomod2nix.legacyPackages.${system}.gomod2nix
             ];
             
+            # search needs FTS5 compiled into sqlite
+            GOFLAGS="-tags=sqlite_fts5";
             FINCH_DB_FILE="database.db";
             FINCH_PORT="9000";
             FINCH_TEMPLATE_DIR="templates";
             FINCH_MEDIA_DIR="media";
+            FINCH_DEV="true";
             FINCH_SECRET="not-a-real-secret";
             FINCH_ITEMS_PER_PAGE="2";
             FINCH_ALLOW_REGISTRATION="true";
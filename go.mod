@@ -5,15 +5,19 @@ go 1.25.0
 require (
 	github.com/braintree/manners v0.0.0-20160418043613-82a8879fc5fd
 	github.com/gorilla/feeds v0.0.0-20160207162205-441264de03a8
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v0.0.0-20160922145804-ca9ada445741
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/microcosm-cc/bluemonday v1.0.27
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d
 	github.com/russross/blackfriday v0.0.0-20151110051855-0b647d0506a6
 	golang.org/x/crypto v0.52.0
 )
 
 require (
+	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/gorilla/context v1.1.1 // indirect
-	github.com/gorilla/securecookie v1.1.1 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
 	github.com/shurcooL/sanitized_anchor_name v0.0.0-20160918041101-1dba4b3954bc // indirect
+	golang.org/x/net v0.54.0 // indirect
 )
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registrationMode is who can make an account
+type registrationMode string
+
+const (
+	registrationClosed registrationMode = "closed"
+	registrationOpen   registrationMode = "open"
+	// only people with an invite code from an existing user
+	registrationInvite registrationMode = "invite"
+)
+
+// parseRegistrationMode reads FINCH_ALLOW_REGISTRATION. "true" is
+// still open registration; anything unrecognised is closed.
+func parseRegistrationMode(v string) registrationMode {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true", "open":
+		return registrationOpen
+	case "invite":
+		return registrationInvite
+	}
+	return registrationClosed
+}
+
+const (
+	maxInviteUses     = 100
+	maxInviteLifetime = 30 * 24 * time.Hour
+)
+
+type invite struct {
+	ID      int
+	MaxUses int
+	Uses    int
+	Created int
+	Expires int
+}
+
+func (i invite) CreatedTime() time.Time {
+	return time.Unix(int64(i.Created), 0)
+}
+
+func (i invite) ExpiresTime() time.Time {
+	return time.Unix(int64(i.Expires), 0)
+}
+
+// newInviteCode is short enough to read out or paste in a message
+func newInviteCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(totpEncoding.EncodeToString(b)), nil
+}
+
+func normalizeInviteCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+func createInviteHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, sr *settingsResponse) error {
+		uses, err := strconv.Atoi(r.FormValue("uses"))
+		if err != nil {
+			return invalid("number of uses must be a number")
+		}
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil {
+			return invalid("days must be a number")
+		}
+		inv, code, err := s.CreateInvite(r.Context(), u, uses, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		sr.NewInvite = inv
+		sr.NewInviteLink = s.BaseURL + "/register/?invite=" + code
+		return nil
+	}, "invite created")
+}
+
+func deleteInviteHandler(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			id, err := strconv.Atoi(r.PathValue("id"))
+			if err != nil {
+				errorPage(w, ctx, http.StatusNotFound, "invite not found")
+				return
+			}
+			if err := s.DeleteInvite(r.Context(), *ctx.User, id); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/", http.StatusFound)
+		})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRegistrationMode(t *testing.T) {
+	for in, want := range map[string]registrationMode{
+		"true":   registrationOpen,
+		"open":   registrationOpen,
+		"invite": registrationInvite,
+		"INVITE": registrationInvite,
+		"false":  registrationClosed,
+		"":       registrationClosed,
+		"yes":    registrationClosed,
+	} {
+		if got := parseRegistrationMode(in); got != want {
+			t.Errorf("%q: expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+var inviteLinkRE = regexp.MustCompile(`/register/\?invite=([a-z2-7]+)`)
+
+func TestInviteRegistration(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	s.now = clock.Now
+	s.SetRegistration(ctx, registrationInvite)
+	s.CreateUser(ctx, "host", "password")
+	cookies := loginCookies(t, handler, "host", "password")
+
+	register := func(username, code string) *http.Response {
+		return formRequest(handler, "/register/", url.Values{
+			"username": {username}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}, "invite": {code},
+		}, nil)
+	}
+	if resp := register("gatecrasher", ""); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a code to be required, got %d", resp.StatusCode)
+	}
+	if resp := register("gatecrasher", "madeup"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a made up code to be refused, got %d", resp.StatusCode)
+	}
+
+	resp := formRequest(handler, "/settings/invites/", url.Values{"uses": {"2"}, "days": {"7"}}, cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("creating an invite: expected 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	m := inviteLinkRE.FindStringSubmatch(string(body))
+	if m == nil {
+		t.Fatal("expected the invite link on the page")
+	}
+	code := m[1]
+
+	if rr := apiRequest(handler, "GET", "/register/?invite="+code, "", nil); !strings.Contains(rr.Body.String(), `value="`+code+`"`) {
+		t.Error("expected the invite link to fill in the code")
+	}
+	for _, name := range []string{"guest1", "guest2"} {
+		if resp := register(name, strings.ToUpper(code)); resp.StatusCode != http.StatusFound {
+			t.Fatalf("%s: expected to register with the code, got %d", name, resp.StatusCode)
+		}
+	}
+	if resp := register("guest3", code); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a used up invite to be refused, got %d", resp.StatusCode)
+	}
+	if _, err := s.GetUser(ctx, "guest3"); !errors.Is(err, errNotFound) {
+		t.Error("a refused registration still made an account")
+	}
+
+	guest, _ := s.GetUser(ctx, "guest1")
+	if guest.InvitedBy != "host" {
+		t.Errorf("expected guest1 to be invited by host, got %q", guest.InvitedBy)
+	}
+	host, _ := s.GetUser(ctx, "host")
+	if names, _ := s.GetInvitees(ctx, *host); len(names) != 2 {
+		t.Errorf("expected host to have two invitees, got %v", names)
+	}
+	invites, _ := s.GetUserInvites(ctx, *host)
+	if len(invites) != 1 || invites[0].Uses != 2 {
+		t.Errorf("expected one invite used twice, got %+v", invites)
+	}
+
+	// expiry
+	_, code, err := s.CreateInvite(ctx, *host, 1, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateInvite failed: %v", err)
+	}
+	clock.Advance(25 * time.Hour)
+	if _, err := s.Register(ctx, "late", "tall ship 42", "tall ship 42", code); !errors.Is(err, errValidation) {
+		t.Errorf("expected an expired invite to be refused, got %v", err)
+	}
+
+	// a taken username doesn't use up the invite
+	_, code, _ = s.CreateInvite(ctx, *host, 1, 24*time.Hour)
+	if _, err := s.Register(ctx, "guest1", "tall ship 42", "tall ship 42", code); !errors.Is(err, errConflict) {
+		t.Errorf("expected a conflict for a taken username, got %v", err)
+	}
+	if _, err := s.Register(ctx, "guest4", "tall ship 42", "tall ship 42", code); err != nil {
+		t.Errorf("expected the invite to still work, got %v", err)
+	}
+}
+
+func TestInviteLimits(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	u, _ := s.CreateUser(ctx, "inviter", "password")
+
+	if _, _, err := s.CreateInvite(ctx, *u, 1, time.Hour); !errors.Is(err, errForbidden) {
+		t.Errorf("expected no invites outside invite mode, got %v", err)
+	}
+	s.SetRegistration(ctx, registrationInvite)
+	for _, tc := range []struct {
+		uses     int
+		lifetime time.Duration
+	}{
+		{0, time.Hour}, {maxInviteUses + 1, time.Hour}, {1, 0}, {1, maxInviteLifetime + time.Hour},
+	} {
+		if _, _, err := s.CreateInvite(ctx, *u, tc.uses, tc.lifetime); !errors.Is(err, errValidation) {
+			t.Errorf("%d uses for %v: expected a validation error, got %v", tc.uses, tc.lifetime, err)
+		}
+	}
+
+	// revoking
+	inv, code, _ := s.CreateInvite(ctx, *u, 1, time.Hour)
+	other, _ := s.CreateUser(ctx, "other", "password")
+	if err := s.DeleteInvite(ctx, *other, inv.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("expected someone else's invite to be not found, got %v", err)
+	}
+	if err := s.DeleteInvite(ctx, *u, inv.ID); err != nil {
+		t.Fatalf("DeleteInvite failed: %v", err)
+	}
+	if _, err := s.Register(ctx, "toolate", "tall ship 42", "tall ship 42", code); !errors.Is(err, errValidation) {
+		t.Errorf("expected a revoked invite to be refused, got %v", err)
+	}
+
+	// closed means closed
+	s.SetRegistration(ctx, registrationClosed)
+	if rr := apiRequest(handler, "GET", "/register/", "", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("expected the register page to be gone, got %d", rr.Code)
+	}
+	resp := formRequest(handler, "/register/", url.Values{"username": {"closedout"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected registering to be refused, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// both failures get the same message, so the login form can't be
+// used to find out which usernames exist
+var (
+	errBadLogin        = errors.New("invalid username or password")
+	errTooManyAttempts = errors.New("too many failed logins, try again later")
+	errBadCode         = errors.New("invalid authentication code")
+	// only said once the password is right, so it doesn't give
+	// away anything about other accounts
+	errAccountDisabled = forbidden("this account has been disabled")
+)
+
+const (
+	// failures allowed from an IP or for a username before each
+	// further attempt has to wait, doubling every time
+	loginFreeAttempts = 3
+	loginBackoffBase  = time.Second
+	loginBackoffMax   = 15 * time.Minute
+	// how long a quiet key is remembered
+	loginForget = time.Hour
+
+	// failures in a row before the account itself is locked
+	lockoutThreshold = 10
+	lockoutDuration  = 15 * time.Minute
+)
+
+// reasons recorded in the login_attempt audit log
+const (
+	loginUnknownUser = "unknown user"
+	loginBadPassword = "bad password"
+	loginLocked      = "locked"
+	loginBadCode     = "bad two factor code"
+	loginDisabled    = "disabled"
+)
+
+type loginAttempt struct {
+	Username  string
+	IP        string
+	Reason    string
+	Attempted int
+}
+
+func (a loginAttempt) Time() time.Time {
+	return time.Unix(int64(a.Attempted), 0)
+}
+
+type backoff struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// loginLimiter slows down repeated failures from one IP or against
+// one username. it lives in memory, so a restart forgets it, but
+// the account lockout in the database doesn't.
+type loginLimiter struct {
+	mu   sync.Mutex
+	keys map[string]*backoff
+	now  func() time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{keys: make(map[string]*backoff), now: time.Now}
+}
+
+// Wait is how long until the keys can try again. zero means now.
+func (l *loginLimiter) Wait(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	for _, k := range keys {
+		b, ok := l.keys[k]
+		if !ok {
+			continue
+		}
+		if now.Sub(b.last) > loginForget {
+			delete(l.keys, k)
+			continue
+		}
+		if d := b.until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (l *loginLimiter) Fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, k := range keys {
+		b, ok := l.keys[k]
+		if !ok {
+			b = &backoff{}
+			l.keys[k] = b
+		}
+		b.failures++
+		b.last = now
+		if over := b.failures - loginFreeAttempts; over > 0 {
+			d := loginBackoffMax
+			if over < 20 {
+				d = min(loginBackoffBase<<(over-1), loginBackoffMax)
+			}
+			b.until = now.Add(d)
+		}
+	}
+	l.prune(now)
+}
+
+func (l *loginLimiter) Reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		delete(l.keys, k)
+	}
+}
+
+// prune drops keys that have been quiet long enough to forget, so
+// a stream of made up usernames can't grow the map forever
+func (l *loginLimiter) prune(now time.Time) {
+	if len(l.keys) < 1000 {
+		return
+	}
+	for k, b := range l.keys {
+		if now.Sub(b.last) > loginForget {
+			delete(l.keys, k)
+		}
+	}
+}
+
+// comparing against a real hash when the user doesn't exist keeps
+// the response time from giving that away
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+	return h
+})
+
+// clientIP is the address the request came from. behind a proxy
+// RemoteAddr is the proxy's, so if the site is told which header
+// the proxy puts the client's address in (Fly-Client-IP on fly.io)
+// that's used instead. X-Forwarded-For and the like are ignored
+// otherwise since anyone can set them.
+func (s *site) clientIP(r *http.Request) string {
+	if s.ClientIPHeader != "" {
+		// a proxy that appends to a list puts the address it saw last
+		v := r.Header.Get(s.ClientIPHeader)
+		if i := strings.LastIndex(v, ","); i >= 0 {
+			v = v[i+1:]
+		}
+		if ip := net.ParseIP(strings.TrimSpace(v)); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginStatus is the status for a login form shown again after a
+// failed attempt
+func loginStatus(err error) int {
+	switch {
+	case errors.Is(err, errTooManyAttempts):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errAccountDisabled):
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := newLoginLimiter()
+	l.now = clock.Now
+
+	for i := 0; i < loginFreeAttempts; i++ {
+		l.Fail("ip:a")
+		if w := l.Wait("ip:a"); w != 0 {
+			t.Fatalf("failure %d: expected no wait yet, got %v", i+1, w)
+		}
+	}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		l.Fail("ip:a")
+		if w := l.Wait("ip:a"); w != want {
+			t.Errorf("expected to wait %v, got %v", want, w)
+		}
+	}
+	if w := l.Wait("ip:b", "user:someone"); w != 0 {
+		t.Errorf("other keys shouldn't wait, got %v", w)
+	}
+	// the longest wait of any key applies
+	if w := l.Wait("ip:b", "ip:a"); w != 4*time.Second {
+		t.Errorf("expected the combined wait to be 4s, got %v", w)
+	}
+
+	for i := 0; i < 40; i++ {
+		l.Fail("ip:a")
+	}
+	if w := l.Wait("ip:a"); w != loginBackoffMax {
+		t.Errorf("expected the wait to cap at %v, got %v", loginBackoffMax, w)
+	}
+
+	clock.Advance(loginForget + time.Minute)
+	if w := l.Wait("ip:a"); w != 0 {
+		t.Errorf("expected a quiet key to be forgotten, got %v", w)
+	}
+	l.Fail("ip:a")
+	if w := l.Wait("ip:a"); w != 0 {
+		t.Errorf("expected a forgotten key to start over, got %v", w)
+	}
+}
+
+func TestLoginFailuresLookTheSame(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	s.CreateUser(ctx, "real", "password")
+
+	_, unknownErr := s.Login(ctx, "imaginary", "password", "10.0.0.1")
+	_, wrongErr := s.Login(ctx, "real", "guess", "10.0.0.2")
+	if !errors.Is(unknownErr, errBadLogin) || !errors.Is(wrongErr, errBadLogin) {
+		t.Errorf("expected errBadLogin for both, got %v and %v", unknownErr, wrongErr)
+	}
+	if u, err := s.Login(ctx, "real", "password", "10.0.0.2"); err != nil || u.Username != "real" {
+		t.Errorf("expected a good login to work, got %v", err)
+	}
+
+	attempts, err := s.GetLoginAttempts(ctx, "imaginary", 10)
+	if err != nil || len(attempts) != 1 || attempts[0].Reason != loginUnknownUser || attempts[0].IP != "10.0.0.1" {
+		t.Errorf("expected the unknown user attempt to be logged, got %v %v", attempts, err)
+	}
+	attempts, _ = s.GetLoginAttempts(ctx, "real", 10)
+	if len(attempts) != 1 || attempts[0].Reason != loginBadPassword {
+		t.Errorf("expected one bad password attempt logged, got %v", attempts)
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Now()}
+	s.logins.now = clock.Now
+	s.CreateUser(ctx, "target", "password")
+
+	for i := 0; i < lockoutThreshold; i++ {
+		// wait out the backoff each time so only the lockout is left
+		clock.Advance(loginBackoffMax)
+		if _, err := s.Login(ctx, "target", "guess", "10.0.0.1"); !errors.Is(err, errBadLogin) {
+			t.Fatalf("attempt %d: expected errBadLogin, got %v", i+1, err)
+		}
+	}
+	// past the backoff for the last attempt but not the lockout
+	clock.Advance(5 * time.Minute)
+	u, _ := s.GetUser(ctx, "target")
+	if int64(u.LockedUntil) <= clock.Now().Unix() {
+		t.Fatal("expected the account to be locked")
+	}
+	if _, err := s.Login(ctx, "target", "password", "10.0.0.9"); !errors.Is(err, errTooManyAttempts) {
+		t.Errorf("expected even the right password to be refused while locked, got %v", err)
+	}
+
+	clock.Advance(lockoutDuration)
+	if _, err := s.Login(ctx, "target", "password", "10.0.0.9"); err != nil {
+		t.Errorf("expected the lockout to expire, got %v", err)
+	}
+	u, _ = s.GetUser(ctx, "target")
+	if u.LockedUntil != 0 {
+		t.Error("expected a good login to clear the lockout")
+	}
+}
+
+func TestLoginHandlerLimits(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "someone", "password")
+
+	login := func(username, password string) *http.Response {
+		return formRequest(handler, "/login/", url.Values{"username": {username}, "password": {password}}, nil)
+	}
+	for _, creds := range [][2]string{{"nobody", "password"}, {"someone", "wrong"}} {
+		resp := login(creds[0], creds[1])
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", creds[0], resp.StatusCode)
+		}
+		body := new(strings.Builder)
+		resp.Write(body)
+		if !strings.Contains(body.String(), "invalid username or password") {
+			t.Errorf("%s: expected the uniform message", creds[0])
+		}
+	}
+
+	// the same address keeps trying
+	for i := 0; i < loginFreeAttempts; i++ {
+		login("someone", "wrong")
+	}
+	if resp := login("someone", "password"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429 while backing off, got %d", resp.StatusCode)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := &site{}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("Fly-Client-IP", "203.0.113.7")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.9")
+
+	// not told about a proxy, so headers can't be trusted
+	if got := s.clientIP(req); got != "10.0.0.1" {
+		t.Errorf("expected RemoteAddr, got %q", got)
+	}
+
+	s.ClientIPHeader = "Fly-Client-IP"
+	if got := s.clientIP(req); got != "203.0.113.7" {
+		t.Errorf("expected the proxy's header, got %q", got)
+	}
+
+	// the last entry is the one the trusted proxy added
+	s.ClientIPHeader = "X-Forwarded-For"
+	if got := s.clientIP(req); got != "203.0.113.9" {
+		t.Errorf("expected the last forwarded address, got %q", got)
+	}
+
+	// garbage or a missing header falls back
+	req.Header.Set("X-Forwarded-For", "not an address")
+	if got := s.clientIP(req); got != "10.0.0.1" {
+		t.Errorf("expected RemoteAddr for a bad header, got %q", got)
+	}
+	req.Header.Del("X-Forwarded-For")
+	if got := s.clientIP(req); got != "10.0.0.1" {
+		t.Errorf("expected RemoteAddr for a missing header, got %q", got)
+	}
+}
+
+func TestLoginLimitsPerClientBehindProxy(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.ClientIPHeader = "Fly-Client-IP"
+	s.CreateUser(context.Background(), "victim", "password")
+	s.CreateUser(context.Background(), "bystander", "password")
+
+	// every request comes in from the same proxy address
+	login := func(ip, username, password string) int {
+		token, cookies := csrfFor(handler, nil)
+		form := url.Values{"username": {username}, "password": {password}, csrfField: {token}}
+		req := httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Fly-Client-IP", ip)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return serve(handler, req).Code
+	}
+	for i := 0; i <= loginFreeAttempts; i++ {
+		login("203.0.113.66", "nobody", "guess")
+	}
+	if code := login("203.0.113.66", "bystander", "password"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the guessing client to be held back, got %d", code)
+	}
+	if code := login("198.51.100.5", "bystander", "password"); code != http.StatusFound {
+		t.Errorf("expected another client to log in, got %d", code)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations are numbered sql files, NNNN_description.sql. they are
+// applied in order, each in its own transaction, and never edited
+// once released. to change the schema, add a new file.
+//
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+type migrationStatus struct {
+	migration
+	// zero if the migration hasn't been applied
+	Applied int
+}
+
+func (m migrationStatus) AppliedTime() time.Time {
+	return time.Unix(int64(m.Applied), 0)
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, f := range files {
+		name := strings.TrimSuffix(path.Base(f), ".sql")
+		num, _, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(num)
+		if !found || err != nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_description.sql", f)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, name)
+		}
+		seen[version] = name
+		body, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{Version: version, Name: name, SQL: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (p *persistence) ensureMigrationsTable(ctx context.Context) error {
+	_, err := p.Database.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+        (version integer primary key, name varchar(256), applied integer)`)
+	return err
+}
+
+// MigrationStatus lists every known migration and when it was applied
+func (p *persistence) MigrationStatus(ctx context.Context) ([]migrationStatus, error) {
+	migrations, err := loadMigrations(migrationFS)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := p.Database.QueryContext(ctx, `select version, applied from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]int)
+	for rows.Next() {
+		var version, when int
+		if err := rows.Scan(&version, &when); err != nil {
+			return nil, err
+		}
+		applied[version] = when
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []migrationStatus
+	for _, m := range migrations {
+		statuses = append(statuses, migrationStatus{migration: m, Applied: applied[m.Version]})
+	}
+	return statuses, nil
+}
+
+// Migrate applies any pending migrations and returns the ones it
+// applied. with dryRun set it only returns what would be applied.
+func (p *persistence) Migrate(ctx context.Context, dryRun bool) ([]migration, error) {
+	statuses, err := p.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, st := range statuses {
+		if st.Applied == 0 {
+			pending = append(pending, st.migration)
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+	var done []migration
+	for _, m := range pending {
+		if err := p.applyMigration(ctx, m); err != nil {
+			return done, fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+		log.Println("applied migration", m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func (p *persistence) applyMigration(ctx context.Context, m migration) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, applied) values (?, ?, ?)`,
+		m.Version, m.Name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runMigrate is the `finch migrate [up|status|dry-run]` subcommand
+func runMigrate(ctx context.Context, p *persistence, args []string, stdout io.Writer) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		done, err := p.Migrate(ctx, false)
+		for _, m := range done {
+			fmt.Fprintf(stdout, "applied %s\n", m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			fmt.Fprintln(stdout, "database is up to date")
+		}
+	case "dry-run":
+		pending, err := p.Migrate(ctx, true)
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			fmt.Fprintln(stdout, "database is up to date")
+		}
+		for _, m := range pending {
+			fmt.Fprintf(stdout, "-- would apply %s\n%s\n", m.Name, m.SQL)
+		}
+	case "status":
+		statuses, err := p.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, st := range statuses {
+			if st.Applied == 0 {
+				fmt.Fprintf(stdout, "%-40s pending\n", st.Name)
+			} else {
+				fmt.Fprintf(stdout, "%-40s applied %s\n", st.Name, st.AppliedTime().UTC().Format(time.RFC3339))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q: use up, status or dry-run", cmd)
+	}
+	return nil
+}
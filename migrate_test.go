@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFS)
+	if err != nil {
+		t.Fatalf("loadMigrations failed: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 {
+		t.Fatalf("expected migrations starting at 1, got %+v", migrations)
+	}
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			t.Errorf("migrations out of order: %s after %s", migrations[i].Name, migrations[i-1].Name)
+		}
+	}
+
+	bad := fstest.MapFS{"migrations/first.sql": {Data: []byte("select 1;")}}
+	if _, err := loadMigrations(bad); err == nil {
+		t.Error("expected an unnumbered migration to be rejected")
+	}
+	dupe := fstest.MapFS{
+		"migrations/0001_a.sql": {Data: []byte("select 1;")},
+		"migrations/0001_b.sql": {Data: []byte("select 1;")},
+	}
+	if _, err := loadMigrations(dupe); err == nil {
+		t.Error("expected duplicate versions to be rejected")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	// setupTestDB has already applied everything
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	done, err := p.Migrate(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if len(done) != 0 {
+		t.Errorf("expected nothing left to apply, applied %d", len(done))
+	}
+
+	statuses, err := p.MigrationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("MigrationStatus failed: %v", err)
+	}
+	for _, st := range statuses {
+		if st.Applied == 0 {
+			t.Errorf("expected %s to be applied", st.Name)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := runMigrate(context.Background(), p, []string{"status"}, &out); err != nil {
+		t.Fatalf("migrate status failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "0001_initial") || strings.Contains(out.String(), "pending") {
+		t.Errorf("unexpected status output %q", out.String())
+	}
+	if err := runMigrate(context.Background(), p, []string{"sideways"}, &out); err == nil {
+		t.Error("expected an unknown subcommand to fail")
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// simulate a database made from the old schema.sql, which is
+	// what 0001 holds, with some data in it and no record of
+	// migrations
+	rows, err := p.Database.Query(`select name from sqlite_master where type = 'table'
+        and name not like 'sqlite_%' and name not like 'post_fts_%'`)
+	if err != nil {
+		t.Fatalf("listing tables: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, name)
+	}
+	rows.Close()
+	drop := "PRAGMA foreign_keys = off;"
+	for _, table := range tables {
+		drop += "DROP TABLE " + table + ";"
+	}
+	if _, err := p.Database.Exec(drop + "PRAGMA foreign_keys = on;"); err != nil {
+		t.Fatalf("dropping tables: %v", err)
+	}
+	legacy, _ := migrationFS.ReadFile("migrations/0001_initial.sql")
+	_, err = p.Database.Exec(string(legacy) + `
+        INSERT INTO users (id, username, password) VALUES (1, 'old', 'x');
+        INSERT INTO post (id, user_id, uuid, body, posted) VALUES (1, 1, 'u1', 'an old post', 1);`)
+	if err != nil {
+		t.Fatalf("setting up legacy db: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runMigrate(context.Background(), p, []string{"dry-run"}, &out); err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "would apply 0004_post_search") {
+		t.Errorf("unexpected dry run output %q", out.String())
+	}
+	if _, err := p.Database.Exec(`select count(*) from post_fts`); err == nil {
+		t.Error("dry run should not change the database")
+	}
+
+	if _, err := p.Migrate(context.Background(), false); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	results, err := p.SearchPosts(context.Background(), searchQuery{Text: "old"}, 10, 0)
+	if err != nil {
+		t.Fatalf("SearchPosts failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Errorf("expected existing posts to be indexed, got %d", len(results))
+	}
+}
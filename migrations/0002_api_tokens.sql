@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS api_token (id integer primary key, user_id integer, token_hash varchar(64), label varchar(64), created integer, last_used integer);
+
+CREATE UNIQUE INDEX IF NOT EXISTS api_token_token_hash on api_token (token_hash);
+CREATE INDEX IF NOT EXISTS api_token_user_id on api_token (user_id);
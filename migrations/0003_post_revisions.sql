@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS post_revision (id integer primary key, post_id integer, body text, edited integer);
+
+CREATE INDEX IF NOT EXISTS post_revision_post_id on post_revision (post_id);
@@ -0,0 +1,6 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS post_fts USING fts5(body, tokenize=unicode61);
+
+-- index anything posted before search existed, without the
+-- characters snippets are marked with (see searchText)
+INSERT INTO post_fts (rowid, body)
+  SELECT id, replace(replace(body, char(2), ' '), char(3), ' ') FROM post WHERE id NOT IN (SELECT rowid FROM post_fts);
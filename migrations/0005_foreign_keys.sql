@@ -0,0 +1,29 @@
+-- postchannel and post_revision rows belong to a post (and a
+-- channel), so let sqlite clean them up. sqlite can't add a foreign
+-- key to an existing table, so both are rebuilt, dropping any rows
+-- that were already orphaned.
+CREATE TABLE postchannel_new (
+    id integer primary key,
+    post_id integer not null references post (id) on delete cascade,
+    channel_id integer not null references channel (id) on delete cascade
+);
+INSERT INTO postchannel_new (id, post_id, channel_id)
+    SELECT id, post_id, channel_id FROM postchannel
+    WHERE post_id IN (SELECT id FROM post) AND channel_id IN (SELECT id FROM channel);
+DROP TABLE postchannel;
+ALTER TABLE postchannel_new RENAME TO postchannel;
+CREATE INDEX postchannel_post_id on postchannel (post_id);
+CREATE INDEX postchannel_channel_id on postchannel (channel_id);
+
+CREATE TABLE post_revision_new (
+    id integer primary key,
+    post_id integer not null references post (id) on delete cascade,
+    body text,
+    edited integer
+);
+INSERT INTO post_revision_new (id, post_id, body, edited)
+    SELECT id, post_id, body, edited FROM post_revision
+    WHERE post_id IN (SELECT id FROM post);
+DROP TABLE post_revision;
+ALTER TABLE post_revision_new RENAME TO post_revision;
+CREATE INDEX post_revision_post_id on post_revision (post_id);
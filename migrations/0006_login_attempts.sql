@@ -0,0 +1,16 @@
+-- consecutive failed logins, and when a lockout from too many of
+-- them ends (unix time, 0 if not locked)
+ALTER TABLE users ADD COLUMN failed_logins integer not null default 0;
+ALTER TABLE users ADD COLUMN locked_until integer not null default 0;
+
+-- audit log of failed logins. username is whatever was typed, so
+-- it may not belong to any account.
+CREATE TABLE login_attempt (
+    id integer primary key,
+    username varchar(256),
+    ip varchar(64),
+    reason varchar(32),
+    attempted integer
+);
+CREATE INDEX login_attempt_username on login_attempt (username);
+CREATE INDEX login_attempt_attempted on login_attempt (attempted);
@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN display_name varchar(64) not null default '';
+ALTER TABLE users ADD COLUMN bio text not null default '';
+
+-- one time password reset links. only a hash of the secret in the
+-- link is kept, like api_token.
+CREATE TABLE password_reset (
+    id integer primary key,
+    user_id integer not null references users (id) on delete cascade,
+    token_hash varchar(64) not null,
+    created integer,
+    expires integer,
+    used integer not null default 0
+);
+CREATE UNIQUE INDEX password_reset_token_hash on password_reset (token_hash);
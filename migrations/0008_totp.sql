@@ -0,0 +1,17 @@
+-- two factor auth. totp_secret is set when enrollment starts but
+-- isn't checked at login until totp_enabled is set by a
+-- confirmation code. totp_last_step is the last time step a code
+-- was accepted for, so a code can't be used twice.
+ALTER TABLE users ADD COLUMN totp_secret varchar(64) not null default '';
+ALTER TABLE users ADD COLUMN totp_enabled integer not null default 0;
+ALTER TABLE users ADD COLUMN totp_last_step integer not null default 0;
+
+-- one time recovery codes for when the authenticator is lost.
+-- only hashes are stored.
+CREATE TABLE recovery_code (
+    id integer primary key,
+    user_id integer not null references users (id) on delete cascade,
+    code_hash varchar(64) not null,
+    used integer not null default 0
+);
+CREATE INDEX recovery_code_user_id on recovery_code (user_id);
@@ -0,0 +1,16 @@
+-- invite codes for invite only registration. like API tokens only
+-- a hash of the code is kept.
+CREATE TABLE invite (
+    id integer primary key,
+    created_by integer not null references users (id) on delete cascade,
+    code_hash varchar(64) not null,
+    max_uses integer not null default 1,
+    uses integer not null default 0,
+    created integer,
+    expires integer
+);
+CREATE UNIQUE INDEX invite_code_hash on invite (code_hash);
+CREATE INDEX invite_created_by on invite (created_by);
+
+-- who invited the user, if anyone
+ALTER TABLE users ADD COLUMN invited_by integer references users (id) on delete set null;
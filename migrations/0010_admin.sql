@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN is_admin integer not null default 0;
+ALTER TABLE users ADD COLUMN disabled integer not null default 0;
+
+-- settings admins can change while the site is running. they
+-- override the environment variables the site started with.
+CREATE TABLE site_setting (
+    name varchar(64) primary key,
+    value text not null
+);
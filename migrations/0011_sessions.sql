@@ -0,0 +1,15 @@
+-- sessions live here and the cookie only carries the id, so they
+-- can be listed and revoked. id_hash is a sha256 of the id, like
+-- api tokens. user_id is null until someone logs in.
+CREATE TABLE session (
+    id_hash varchar(64) primary key,
+    user_id integer references users (id) on delete cascade,
+    data blob not null,
+    user_agent varchar(256) not null default '',
+    ip varchar(64) not null default '',
+    created integer not null,
+    last_seen integer not null,
+    expires integer not null
+);
+CREATE INDEX session_user on session (user_id);
+CREATE INDEX session_expires on session (expires);
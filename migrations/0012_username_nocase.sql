@@ -0,0 +1,6 @@
+-- usernames are matched exactly, but two that only differ in case
+-- would look like the same person at /u/{username}/, so only one
+-- of them can exist. usernames are ascii, which NOCASE covers.
+-- if an existing database has such a pair, one has to be renamed
+-- by hand before this will apply.
+CREATE UNIQUE INDEX users_username_nocase on users (username COLLATE NOCASE);
@@ -1,90 +1,162 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"log"
+	"runtime"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/nu7hatch/gouuid"
 )
 
+const sqliteDriver = "sqlite3"
+
+// errNoFTS5 means the binary was built without the sqlite_fts5 tag,
+// which search needs. go has no way for a module to turn a build
+// tag on for itself, so it has to be passed every time; make, the
+// Dockerfile and the nix build and shell all do.
+var errNoFTS5 = errors.New("sqlite was built without FTS5, which search needs: " +
+	"build and test with -tags sqlite_fts5, or set GOFLAGS=-tags=sqlite_fts5 " +
+	"(go env -w GOFLAGS=-tags=sqlite_fts5 makes it stick)")
+
 type persistence struct {
+	// Database is the one connection all writes go through
 	Database *sql.DB
+	// Reader is a pool of read only connections. in WAL mode
+	// they don't block on each other or on the writer.
+	Reader *sql.DB
 }
 
-func newPersistence(dbfile string) *persistence {
-	db, err := sql.Open("sqlite3", dbfile)
+func newPersistence(dbfile string) (*persistence, error) {
+	// with only one writer connection there's no point in sqlite's
+	// deferred transactions, which can fail with SQLITE_BUSY when
+	// a reader gets in the way of upgrading to a write lock.
+	// foreign keys are off by default in sqlite and have to be
+	// turned on for every connection.
+	db, err := sql.Open(sqliteDriver,
+		"file:"+dbfile+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// make sure the file exists and is in WAL mode before
+	// opening it read only
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := checkFTS5(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	reader, err := sql.Open(sqliteDriver, "file:"+dbfile+"?mode=ro&_busy_timeout=5000")
 	if err != nil {
-		log.Fatal(err)
+		db.Close()
+		return nil, err
+	}
+	// the open connections aren't capped: the list queries look up
+	// users and channels while still holding their rows, so a
+	// capped pool could deadlock under load
+	reader.SetMaxIdleConns(max(4, runtime.NumCPU()))
+	return &persistence{Database: db, Reader: reader}, nil
+}
+
+func checkFTS5(db *sql.DB) error {
+	var fts5 bool
+	if err := db.QueryRow(`select sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5); err != nil {
+		return err
+	}
+	if !fts5 {
+		return errNoFTS5
 	}
-	return &persistence{Database: db}
+	return nil
 }
 
 func (p *persistence) Close() {
+	p.Reader.Close()
 	p.Database.Close()
 }
 
-func (p persistence) GetUser(username string) (*user, error) {
-	stmt, err := p.Database.Prepare("select id, password from users where username = ?")
-	if err != nil {
-		log.Fatal(err)
-		return nil, err
-	}
-	defer stmt.Close()
+func (p persistence) GetUser(ctx context.Context, username string) (*user, error) {
+	q := userSelect + ` where u.username = ?`
+	return p.scanUser(ctx, q, username)
+}
 
-	var id int
-	var password string
+func (p persistence) getUserByID(ctx context.Context, id int) (*user, error) {
+	q := userSelect + ` where u.id = ?`
+	return p.scanUser(ctx, q, id)
+}
+
+// userSelect is the query scanUser expects, for adding a where
+// clause to. u is the user and inv is who invited them.
+const userSelect = `select u.id, u.username, u.password, u.locked_until,
+        u.display_name, u.bio, u.totp_secret, u.totp_enabled, u.totp_last_step,
+        coalesce(inv.username, ''), u.is_admin, u.disabled
+        from users u left join users inv on inv.id = u.invited_by`
 
-	err = stmt.QueryRow(username).Scan(&id, &password)
+func (p persistence) scanUser(ctx context.Context, q string, arg interface{}) (*user, error) {
+	u, err := scanUserRow(p.Reader.QueryRowContext(ctx, q, arg))
 	if err != nil {
-		return nil, err
+		return nil, lookupError("user", err)
 	}
-	return &user{ID: id, Username: username, Password: []byte(password)}, err
+	return u, nil
 }
 
-func (p persistence) getUserByID(id int) (*user, error) {
-	q := `select username, password from users where id = ?`
-	stmt, err := p.Database.Prepare(q)
+// scanUserRow reads one row of a userSelect query
+func scanUserRow(row interface{ Scan(...interface{}) error }) (*user, error) {
+	var u user
+	var password string
+	err := row.Scan(&u.ID, &u.Username, &password,
+		&u.LockedUntil, &u.DisplayName, &u.Bio, &u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep,
+		&u.InvitedBy, &u.IsAdmin, &u.Disabled)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	defer stmt.Close()
+	u.Password = []byte(password)
+	return &u, nil
+}
 
-	var username string
-	var password string
+func (p *persistence) CreateUser(ctx context.Context, username, password string) (*user, error) {
+	return insertUser(ctx, p.Database, username, password, nil)
+}
 
-	err = stmt.QueryRow(id).Scan(&username, &password)
-	if err != nil {
-		return nil, err
-	}
-	return &user{ID: id, Username: username, Password: []byte(password)}, nil
+// execer is what *sql.DB and *sql.Tx have in common
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
-func (p *persistence) CreateUser(username, password string) (*user, error) {
-	var user user
-	user.Username = username
-	encpassword := user.SetPassword(password)
+func insertUser(ctx context.Context, db execer, username, password string, invitedBy *int) (*user, error) {
+	var u user
+	u.Username = username
+	encpassword := u.SetPassword(password)
 
-	tx, err := p.Database.Begin()
+	r, err := db.ExecContext(ctx, "insert into users(username, password, invited_by) values(?, ?, ?)",
+		username, encpassword, invitedBy)
+	if isUniqueViolation(err) {
+		return nil, &siteError{Kind: errConflict, Msg: "that username is taken", Err: err,
+			Fields: map[string]string{"username": "that username is taken"}}
+	}
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	stmt, err := tx.Prepare("insert into users(username, password) values(?, ?)")
+	id, err := r.LastInsertId()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(username, encpassword)
-	tx.Commit()
+	u.ID = int(id)
+	u.Password = []byte(encpassword)
+	return &u, nil
+}
 
-	u, _ := p.GetUser(username)
-	return u, nil
+// isUniqueViolation spots an insert that clashed with a unique index
+func isUniqueViolation(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && serr.ExtendedCode == sqlite3.ErrConstraintUnique
 }
 
 type channel struct {
@@ -94,18 +166,21 @@ type channel struct {
 	Label string
 }
 
-func (p persistence) GetUserChannels(u user) ([]*channel, error) {
+func slugify(label string) string {
+	return strings.ToLower(strings.Replace(label, " ", "_", -1))
+}
+
+func (p persistence) GetUserChannels(ctx context.Context, u user) ([]*channel, error) {
 	q := `select id, slug, label from channel where user_id = ? order by slug asc`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var channels []*channel
 
-	rows, err := stmt.Query(u.ID)
+	rows, err := stmt.QueryContext(ctx, u.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -114,122 +189,98 @@ func (p persistence) GetUserChannels(u user) ([]*channel, error) {
 		var id int
 		var slug string
 		var label string
-		rows.Scan(&id, &slug, &label)
+		if err := rows.Scan(&id, &slug, &label); err != nil {
+			return nil, err
+		}
 		c := &channel{ID: id, Slug: slug, Label: label}
 		channels = append(channels, c)
 	}
-	return channels, nil
+	return channels, rows.Err()
 }
 
-func (p *persistence) AddChannels(u user, names []string) ([]*channel, error) {
+func (p *persistence) AddChannels(ctx context.Context, u user, names []string) ([]*channel, error) {
 	var created []*channel
-	tx, err := p.Database.Begin()
+	for _, label := range names {
+		if label == "" {
+			continue
+		}
+		created = append(created, newChannel(u, label))
+	}
+	tx, err := p.Database.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	q := `insert into channel(user_id, slug, label) values(?, ?, ?)`
-	stmt, err := tx.Prepare(q)
-	if err != nil {
-		log.Fatal(err)
+	defer tx.Rollback()
+	if err := createChannels(ctx, tx, created); err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
-	for _, label := range names {
-		if label == "" {
-			continue
-		}
-		slug := strings.ToLower(strings.Replace(label, " ", "_", -1))
-		r, err := stmt.Exec(u.ID, slug, label)
-
-		id, err := r.LastInsertId()
-		if err != nil {
-			log.Println("error getting last inserted id", err)
-			return nil, err
-		}
-		c := &channel{ID: int(id), Slug: slug, Label: label, User: &u}
-		created = append(created, c)
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-
-	tx.Commit()
 	return created, nil
 }
 
-func (p *persistence) DeleteChannel(c *channel) error {
-	q1 := `delete from postchannel where channel_id = ?`
-	q2 := `delete from channel where id = ?`
+// newChannel is a channel that hasn't been saved yet. passed to
+// AddPost or UpdatePost, it's created along with the post.
+func newChannel(u user, label string) *channel {
+	return &channel{Slug: slugify(label), Label: label, User: &u}
+}
 
-	tx, err := p.Database.Begin()
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	stmt, err := tx.Prepare(q1)
+// createChannels inserts the channels that don't have an id yet and
+// fills theirs in
+func createChannels(ctx context.Context, tx *sql.Tx, channels []*channel) error {
+	q := `insert into channel(user_id, slug, label) values(?, ?, ?)`
+	stmt, err := tx.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(c.ID)
-	if err != nil {
-		return err
-	}
-
-	stmt2, err := tx.Prepare(q2)
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	defer stmt2.Close()
-	_, err = stmt2.Exec(c.ID)
-	if err != nil {
-		return err
+	for _, c := range channels {
+		if c == nil || c.ID != 0 {
+			continue
+		}
+		r, err := stmt.ExecContext(ctx, c.User.ID, c.Slug, c.Label)
+		if err != nil {
+			return err
+		}
+		id, err := r.LastInsertId()
+		if err != nil {
+			return err
+		}
+		c.ID = int(id)
 	}
-
-	tx.Commit()
 	return nil
 }
 
-func (p *persistence) DeletePost(post *post) error {
-	q1 := `delete from postchannel where post_id = ?`
-	q2 := `delete from post where id = ?`
+// DeleteChannel takes the channel off any posts in it too, by way
+// of the foreign key on postchannel
+func (p *persistence) DeleteChannel(ctx context.Context, c *channel) error {
+	_, err := p.Database.ExecContext(ctx, `delete from channel where id = ?`, c.ID)
+	return err
+}
 
-	tx, err := p.Database.Begin()
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	stmt, err := tx.Prepare(q1)
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	defer stmt.Close()
-	_, err = stmt.Exec(post.ID)
+// DeletePost removes a post along with its channel memberships and
+// revisions, which cascade, and its search index entry, which can't
+func (p *persistence) DeletePost(ctx context.Context, post *post) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	stmt2, err := tx.Prepare(q2)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := tx.ExecContext(ctx, `delete from post where id = ?`, post.ID); err != nil {
 		return err
 	}
-	defer stmt2.Close()
-	_, err = stmt2.Exec(post.ID)
-	if err != nil {
+	if _, err := tx.ExecContext(ctx, `delete from post_fts where rowid = ?`, post.ID); err != nil {
 		return err
 	}
-
-	tx.Commit()
-	return nil
+	return tx.Commit()
 }
 
-func (p persistence) GetChannel(u user, slug string) (*channel, error) {
+func (p persistence) GetChannel(ctx context.Context, u user, slug string) (*channel, error) {
 	q := `select id, label from channel where user_id = ? AND slug = ?`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -237,18 +288,17 @@ func (p persistence) GetChannel(u user, slug string) (*channel, error) {
 	var id int
 	var label string
 
-	err = stmt.QueryRow(u.ID, slug).Scan(&id, &label)
+	err = stmt.QueryRowContext(ctx, u.ID, slug).Scan(&id, &label)
 	if err != nil {
-		return nil, err
+		return nil, lookupError("channel", err)
 	}
 	return &channel{ID: id, User: &u, Slug: slug, Label: label}, nil
 }
 
-func (p persistence) GetChannelByID(id int) (*channel, error) {
+func (p persistence) GetChannelByID(ctx context.Context, id int) (*channel, error) {
 	q := `select user_id, slug, label from channel where id = ?`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -257,12 +307,12 @@ func (p persistence) GetChannelByID(id int) (*channel, error) {
 	var label string
 	var userID int
 
-	err = stmt.QueryRow(id).Scan(&userID, &slug, &label)
+	err = stmt.QueryRowContext(ctx, id).Scan(&userID, &slug, &label)
 	if err != nil {
-		return nil, err
+		return nil, lookupError("channel", err)
 	}
 
-	u, err := p.getUserByID(userID)
+	u, err := p.getUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -270,11 +320,10 @@ func (p persistence) GetChannelByID(id int) (*channel, error) {
 	return &channel{ID: id, User: u, Slug: slug, Label: label}, nil
 }
 
-func (p persistence) getPost(id int) (*post, error) {
+func (p persistence) getPost(ctx context.Context, id int) (*post, error) {
 	q := `select user_id, uuid, body, posted from post where id = ?`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -284,13 +333,12 @@ func (p persistence) getPost(id int) (*post, error) {
 	var posted int
 	var uu string
 
-	err = stmt.QueryRow(id).Scan(&userID, &uu, &body, &posted)
+	err = stmt.QueryRowContext(ctx, id).Scan(&userID, &uu, &body, &posted)
 	if err != nil {
-		log.Println("error querying by post id", err)
-		return nil, err
+		return nil, lookupError("post", err)
 	}
 
-	u, err := p.getUserByID(userID)
+	u, err := p.getUserByID(ctx, userID)
 	if err != nil {
 		log.Println("error getting post user", err)
 		return nil, err
@@ -299,11 +347,10 @@ func (p persistence) getPost(id int) (*post, error) {
 	return &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted}, nil
 }
 
-func (p persistence) GetPostByUUID(uu string) (*post, error) {
+func (p persistence) GetPostByUUID(ctx context.Context, uu string) (*post, error) {
 	q := `select id, user_id, body, posted from post where uuid = ?`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
@@ -313,13 +360,12 @@ func (p persistence) GetPostByUUID(uu string) (*post, error) {
 	var userID int
 	var posted int
 
-	err = stmt.QueryRow(uu).Scan(&id, &userID, &body, &posted)
+	err = stmt.QueryRowContext(ctx, uu).Scan(&id, &userID, &body, &posted)
 	if err != nil {
-		log.Println("error querying by post id", err)
-		return nil, err
+		return nil, lookupError("post", err)
 	}
 
-	u, err := p.getUserByID(userID)
+	u, err := p.getUserByID(ctx, userID)
 	if err != nil {
 		log.Println("error getting post user", err)
 		return nil, err
@@ -328,21 +374,21 @@ func (p persistence) GetPostByUUID(uu string) (*post, error) {
 	return &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted}, nil
 }
 
-func (p persistence) GetAllPosts(limit int, offset int) ([]*post, error) {
-	q := `select id, uuid, user_id, body, posted
-        from post order by posted desc limit ? offset ?`
-	stmt, err := p.Database.Prepare(q)
+func (p persistence) GetAllPosts(ctx context.Context, limit int, offset int) ([]*post, error) {
+	q := `select p.id, p.uuid, p.user_id, p.body, p.posted
+        from post p join users u on u.id = p.user_id
+        where u.disabled = 0 order by p.posted desc limit ? offset ?`
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var posts []*post
 
-	rows, err := stmt.Query(limit, offset)
+	rows, err := stmt.QueryContext(ctx, limit, offset)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -351,13 +397,20 @@ func (p persistence) GetAllPosts(limit int, offset int) ([]*post, error) {
 		var body string
 		var posted int
 		var uu string
-		rows.Scan(&id, &uu, &userID, &body, &posted)
-		u, err := p.getUserByID(userID)
-		if err != nil {
+		if err := rows.Scan(&id, &uu, &userID, &body, &posted); err != nil {
+			return nil, err
+		}
+		u, err := p.getUserByID(ctx, userID)
+		if errors.Is(err, errNotFound) {
+			// post.user_id has no foreign key, so a post can
+			// outlive its user
 			continue
 		}
+		if err != nil {
+			return nil, err
+		}
 		post := &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted}
-		channels, err := p.GetPostChannels(post)
+		channels, err := p.GetPostChannels(ctx, post)
 
 		if err != nil {
 			return nil, err
@@ -366,58 +419,58 @@ func (p persistence) GetAllPosts(limit int, offset int) ([]*post, error) {
 
 		posts = append(posts, post)
 	}
-	return posts, nil
+	return posts, rows.Err()
 }
 
-func (p persistence) GetPostChannels(post *post) ([]*channel, error) {
+func (p persistence) GetPostChannels(ctx context.Context, post *post) ([]*channel, error) {
 	q := `select c.id, c.label, c.slug
         from channel c, postchannel pc
         where pc.channel_id = c.id
           and pc.post_id = ?
         order by c.slug asc`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var channels []*channel
 
-	rows, err := stmt.Query(post.ID)
+	rows, err := stmt.QueryContext(ctx, post.ID)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var id int
 		var label string
 		var slug string
-		rows.Scan(&id, &label, &slug)
+		if err := rows.Scan(&id, &label, &slug); err != nil {
+			return nil, err
+		}
 		channel := &channel{ID: id, User: post.User, Label: label, Slug: slug}
 		channels = append(channels, channel)
 	}
-	return channels, nil
+	return channels, rows.Err()
 }
 
-func (p persistence) GetAllPostsInChannel(c channel, limit int, offset int) ([]*post, error) {
+func (p persistence) GetAllPostsInChannel(ctx context.Context, c channel, limit int, offset int) ([]*post, error) {
 	q := `select p.id, p.uuid, p.user_id, p.body, p.posted
         from post p, postchannel pc
         where p.id = pc.post_id
           and pc.channel_id = ?
         order by p.posted desc limit ? offset ?`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var posts []*post
 
-	rows, err := stmt.Query(c.ID, limit, offset)
+	rows, err := stmt.QueryContext(ctx, c.ID, limit, offset)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -426,14 +479,19 @@ func (p persistence) GetAllPostsInChannel(c channel, limit int, offset int) ([]*
 		var body string
 		var posted int
 		var uu string
-		rows.Scan(&id, &uu, &userID, &body, &posted)
-		u, err := p.getUserByID(userID)
-		if err != nil {
+		if err := rows.Scan(&id, &uu, &userID, &body, &posted); err != nil {
+			return nil, err
+		}
+		u, err := p.getUserByID(ctx, userID)
+		if errors.Is(err, errNotFound) {
 			continue
 		}
+		if err != nil {
+			return nil, err
+		}
 		post := &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted}
 
-		channels, err := p.GetPostChannels(post)
+		channels, err := p.GetPostChannels(ctx, post)
 
 		if err != nil {
 			return nil, err
@@ -441,27 +499,72 @@ func (p persistence) GetAllPostsInChannel(c channel, limit int, offset int) ([]*
 		post.Channels = channels
 		posts = append(posts, post)
 	}
-	return posts, nil
-
+	return posts, rows.Err()
 }
 
-func (p persistence) SearchPosts(query string, limit int, offset int) ([]*post, error) {
-	q := `select p.id, p.uuid, p.user_id, p.body, p.posted
+// SearchPosts runs a full text query. the text can use the FTS
+// syntax: "exact phrases", prefix*, AND, OR, NOT and parentheses,
+// and results come back most relevant first. filters are applied
+// as regular predicates. a query with only filters lists the
+// matching posts newest first.
+func (p persistence) SearchPosts(ctx context.Context, query searchQuery, limit int, offset int) ([]*post, error) {
+	var q strings.Builder
+	var args []interface{}
+	if query.Text != "" {
+		q.WriteString(`select p.id, p.uuid, p.user_id, p.body, p.posted,
+          snippet(post_fts, 0, char(2), char(3), '…', 32)
+        from post_fts join post p on p.id = post_fts.rowid
+        where post_fts match ?`)
+		args = append(args, query.Text)
+	} else {
+		q.WriteString(`select p.id, p.uuid, p.user_id, p.body, p.posted, ''
         from post p
-        where p.body like ?
-        order by p.posted desc limit ? offset ?`
-	stmt, err := p.Database.Prepare(q)
+        where 1 = 1`)
+	}
+	q.WriteString(` and p.user_id in (select id from users where disabled = 0)`)
+	if query.From != "" {
+		q.WriteString(` and p.user_id = (select id from users where username = ?)`)
+		args = append(args, query.From)
+	}
+	if query.In != "" {
+		q.WriteString(` and exists (select 1 from postchannel pc, channel c
+            where pc.channel_id = c.id and pc.post_id = p.id and c.slug = ?)`)
+		args = append(args, query.In)
+	}
+	if !query.Before.IsZero() {
+		q.WriteString(` and p.posted < ?`)
+		args = append(args, query.Before.Unix())
+	}
+	if !query.After.IsZero() {
+		q.WriteString(` and p.posted >= ?`)
+		args = append(args, query.After.AddDate(0, 0, 1).Unix())
+	}
+	if query.HasLink {
+		q.WriteString(` and (p.body like '%http://%' or p.body like '%https://%')`)
+	}
+	if query.Text != "" {
+		// bm25 is negative, more relevant is lower
+		q.WriteString(` order by bm25(post_fts), p.posted desc`)
+	} else {
+		q.WriteString(` order by p.posted desc`)
+	}
+	q.WriteString(` limit ? offset ?`)
+	args = append(args, limit, offset)
+
+	stmt, err := p.Reader.PrepareContext(ctx, q.String())
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var posts []*post
 
-	rows, err := stmt.Query("%"+query+"%", limit, offset)
+	rows, err := stmt.QueryContext(ctx, args...)
+	if isSearchSyntaxError(err) {
+		return nil, invalidSearch(err)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -470,14 +573,17 @@ func (p persistence) SearchPosts(query string, limit int, offset int) ([]*post,
 		var body string
 		var posted int
 		var uu string
-		rows.Scan(&id, &uu, &userID, &body, &posted)
-		u, err := p.getUserByID(userID)
+		var snippet string
+		if err := rows.Scan(&id, &uu, &userID, &body, &posted, &snippet); err != nil {
+			return nil, err
+		}
+		u, err := p.getUserByID(ctx, userID)
 		if err != nil {
 			continue
 		}
-		post := &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted}
+		post := &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted, Snippet: snippet}
 
-		channels, err := p.GetPostChannels(post)
+		channels, err := p.GetPostChannels(ctx, post)
 
 		if err != nil {
 			return nil, err
@@ -485,25 +591,30 @@ func (p persistence) SearchPosts(query string, limit int, offset int) ([]*post,
 		post.Channels = channels
 		posts = append(posts, post)
 	}
+	// a bad query only shows up once sqlite starts stepping
+	if err := rows.Err(); isSearchSyntaxError(err) {
+		return nil, invalidSearch(err)
+	} else if err != nil {
+		return nil, err
+	}
 	return posts, nil
 
 }
 
-func (p persistence) GetAllUserPosts(u *user, limit int, offset int) ([]*post, error) {
+func (p persistence) GetAllUserPosts(ctx context.Context, u *user, limit int, offset int) ([]*post, error) {
 	q := `select id, uuid, body, posted
         from post where user_id = ? order by posted desc limit ? offset ?`
-	stmt, err := p.Database.Prepare(q)
+	stmt, err := p.Reader.PrepareContext(ctx, q)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var posts []*post
 
-	rows, err := stmt.Query(u.ID, limit, offset)
+	rows, err := stmt.QueryContext(ctx, u.ID, limit, offset)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -511,9 +622,11 @@ func (p persistence) GetAllUserPosts(u *user, limit int, offset int) ([]*post, e
 		var body string
 		var posted int
 		var uu string
-		rows.Scan(&id, &uu, &body, &posted)
+		if err := rows.Scan(&id, &uu, &body, &posted); err != nil {
+			return nil, err
+		}
 		post := &post{ID: id, UUID: uu, User: u, Body: body, Posted: posted}
-		channels, err := p.GetPostChannels(post)
+		channels, err := p.GetPostChannels(ctx, post)
 
 		if err != nil {
 			return nil, err
@@ -521,46 +634,47 @@ func (p persistence) GetAllUserPosts(u *user, limit int, offset int) ([]*post, e
 		post.Channels = channels
 		posts = append(posts, post)
 	}
-	return posts, nil
+	return posts, rows.Err()
 }
 
-func (p *persistence) AddPost(u user, body string, channels []*channel) (*post, error) {
-	tx, err := p.Database.Begin()
+// AddPost saves a post in the channels given. any of them made with
+// newChannel are created in the same transaction, so a post that
+// fails doesn't leave them behind.
+func (p *persistence) AddPost(ctx context.Context, u user, body string, channels []*channel) (*post, error) {
+	u4, err := uuid.NewV4()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
-	u4, err := uuid.NewV4()
+	tx, err := p.Database.BeginTx(ctx, nil)
 	if err != nil {
-		fmt.Println("error:", err)
 		return nil, err
 	}
+	defer tx.Rollback()
 
 	q := `insert into post(user_id, uuid, body, posted) values(?, ?, ?, ?)`
-	stmt, err := tx.Prepare(q)
+	r, err := tx.ExecContext(ctx, q, u.ID, u4.String(), body, time.Now().Unix())
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	defer stmt.Close()
 
-	r, err := stmt.Exec(u.ID, u4.String(), body, time.Now().Unix())
+	id, err := r.LastInsertId()
 	if err != nil {
-		log.Println("error inserting post", err)
 		return nil, err
 	}
 
-	id, err := r.LastInsertId()
+	_, err = tx.ExecContext(ctx, `insert into post_fts (rowid, body) values (?, ?)`, id, searchText(body))
 	if err != nil {
-		log.Println("error getting last inserted id", err)
+		return nil, err
+	}
+
+	if err := createChannels(ctx, tx, channels); err != nil {
 		return nil, err
 	}
 
 	q2 := `insert into postchannel (post_id, channel_id) values (?, ?)`
-	cstmt, err := tx.Prepare(q2)
+	cstmt, err := tx.PrepareContext(ctx, q2)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	defer cstmt.Close()
@@ -568,19 +682,747 @@ func (p *persistence) AddPost(u user, body string, channels []*channel) (*post,
 		if c == nil {
 			continue
 		}
-		_, err = cstmt.Exec(int(id), c.ID)
+		if _, err := cstmt.ExecContext(ctx, int(id), c.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return p.getPost(ctx, int(id))
+}
+
+func (p *persistence) CreateToken(ctx context.Context, u user, label string) (*apiToken, string, error) {
+	secret, err := newTokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	now := int(time.Now().Unix())
+	q := `insert into api_token(user_id, token_hash, label, created, last_used)
+        values(?, ?, ?, ?, 0)`
+	r, err := p.Database.ExecContext(ctx, q, u.ID, hashToken(secret), label, now)
+	if err != nil {
+		log.Println("error inserting token", err)
+		return nil, "", err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		log.Println("error getting last inserted id", err)
+		return nil, "", err
+	}
+	return &apiToken{ID: int(id), User: &u, Label: label, Created: now}, secret, nil
+}
+
+func (p persistence) GetUserTokens(ctx context.Context, u user) ([]*apiToken, error) {
+	q := `select id, label, created, last_used
+        from api_token where user_id = ? order by created desc`
+	stmt, err := p.Reader.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var tokens []*apiToken
+
+	rows, err := stmt.QueryContext(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var label string
+		var created int
+		var lastUsed int
+		if err := rows.Scan(&id, &label, &created, &lastUsed); err != nil {
+			return nil, err
+		}
+		t := &apiToken{ID: id, User: &u, Label: label, Created: created, LastUsed: lastUsed}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// GetToken looks up a token and its owner by its secret
+func (p persistence) GetToken(ctx context.Context, secret string) (*apiToken, error) {
+	q := `select id, user_id, label, created, last_used from api_token where token_hash = ?`
+	var t apiToken
+	var userID int
+	err := p.Reader.QueryRowContext(ctx, q, hashToken(secret)).Scan(&t.ID, &userID, &t.Label, &t.Created, &t.LastUsed)
+	if err != nil {
+		return nil, lookupError("token", err)
+	}
+	u, err := p.getUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	t.User = u
+	return &t, nil
+}
+
+// TouchToken records that a token was used
+func (p *persistence) TouchToken(ctx context.Context, id int, now time.Time) error {
+	_, err := p.Database.ExecContext(ctx, `update api_token set last_used = ? where id = ?`, now.Unix(), id)
+	return err
+}
+
+// UpdateTokenLabel and DeleteToken are scoped to the user so one
+// user can never touch another's tokens
+func (p *persistence) UpdateTokenLabel(ctx context.Context, u user, id int, label string) error {
+	r, err := p.Database.ExecContext(ctx, `update api_token set label = ? where id = ? and user_id = ?`,
+		label, id, u.ID)
+	if err != nil {
+		return err
+	}
+	return lookupError("token", expectOneRow(r))
+}
+
+func (p *persistence) DeleteToken(ctx context.Context, u user, id int) error {
+	r, err := p.Database.ExecContext(ctx, `delete from api_token where id = ? and user_id = ?`, id, u.ID)
+	if err != nil {
+		return err
+	}
+	return lookupError("token", expectOneRow(r))
+}
+
+func expectOneRow(r sql.Result) error {
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdatePost edits a post in place, keeping its UUID. the previous
+// body is saved as a revision and the channel membership is replaced.
+// new channels are created with it, as in AddPost.
+func (p *persistence) UpdatePost(ctx context.Context, post *post, body string, channels []*channel) (*post, error) {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRowContext(ctx, `select body from post where id = ?`, post.ID).Scan(&previous)
+	if err != nil {
+		return nil, lookupError("post", err)
+	}
+
+	q := `insert into post_revision (post_id, body, edited) values (?, ?, ?)`
+	_, err = tx.ExecContext(ctx, q, post.ID, previous, time.Now().Unix())
+	if err != nil {
+		log.Println("error saving revision", err)
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `update post set body = ? where id = ?`, body, post.ID)
+	if err != nil {
+		log.Println("error updating post", err)
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `update post_fts set body = ? where rowid = ?`, searchText(body), post.ID)
+	if err != nil {
+		log.Println("error reindexing post", err)
+		return nil, err
+	}
+
+	if err := createChannels(ctx, tx, channels); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `delete from postchannel where post_id = ?`, post.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range channels {
+		if c == nil {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `insert into postchannel (post_id, channel_id) values (?, ?)`, post.ID, c.ID)
 		if err != nil {
 			log.Println("error associating channel with post", err)
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return p.getPost(ctx, post.ID)
+}
+
+func (p persistence) GetPostRevisions(ctx context.Context, post *post) ([]*revision, error) {
+	q := `select id, body, edited from post_revision
+        where post_id = ? order by edited asc, id asc`
+	rows, err := p.Reader.QueryContext(ctx, q, post.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*revision
+	for rows.Next() {
+		var id int
+		var body string
+		var edited int
+		if err := rows.Scan(&id, &body, &edited); err != nil {
+			return nil, err
 		}
+		revisions = append(revisions, &revision{ID: id, Post: post, Body: body, Edited: edited})
+	}
+	return revisions, rows.Err()
+}
+
+// RecordLoginFailure adds a failed login to the audit log and, if
+// the username belongs to an account, counts it against that
+// account. after lockoutThreshold failures in a row the account is
+// locked until lockout from now.
+func (p *persistence) RecordLoginFailure(ctx context.Context, username, ip, reason string, now time.Time) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `insert into login_attempt (username, ip, reason, attempted)
+        values (?, ?, ?, ?)`, username, ip, reason, now.Unix())
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update users set failed_logins = failed_logins + 1
+        where username = ?`, username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `update users set failed_logins = 0, locked_until = ?
+        where username = ? and failed_logins >= ?`,
+		now.Add(lockoutDuration).Unix(), username, lockoutThreshold)
+	if err != nil {
+		return err
 	}
+	return tx.Commit()
+}
 
-	tx.Commit()
+// RecordLoginSuccess clears the account's run of failures
+func (p *persistence) RecordLoginSuccess(ctx context.Context, u *user) error {
+	_, err := p.Database.ExecContext(ctx,
+		`update users set failed_logins = 0, locked_until = 0 where id = ?`, u.ID)
+	return err
+}
 
-	post, err := p.getPost(int(id))
+// GetLoginAttempts lists the most recent failed logins for a username
+func (p persistence) GetLoginAttempts(ctx context.Context, username string, limit int) ([]*loginAttempt, error) {
+	q := `select username, ip, reason, attempted from login_attempt
+        where username = ? order by attempted desc, id desc limit ?`
+	rows, err := p.Reader.QueryContext(ctx, q, username, limit)
 	if err != nil {
-		log.Println("error getting post", err)
 		return nil, err
 	}
+	defer rows.Close()
+
+	var attempts []*loginAttempt
+	for rows.Next() {
+		a := &loginAttempt{}
+		if err := rows.Scan(&a.Username, &a.IP, &a.Reason, &a.Attempted); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// UpdatePassword sets a new password, which also lifts any lockout.
+// whoever might have had the old one is cut off: all the user's
+// sessions except keep, and all their API tokens, are revoked.
+func (p *persistence) UpdatePassword(ctx context.Context, u *user, password, keep string) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hashed := u.SetPassword(password)
+	_, err = tx.ExecContext(ctx,
+		`update users set password = ?, failed_logins = 0, locked_until = 0 where id = ?`,
+		hashed, u.ID)
+	if err != nil {
+		return err
+	}
+	if err := revokeCredentials(ctx, tx, u.ID, keep); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revokeCredentials ends a user's sessions, other than keep, and
+// deletes their API tokens
+func revokeCredentials(ctx context.Context, tx *sql.Tx, userID int, keep string) error {
+	if _, err := tx.ExecContext(ctx, `delete from session where user_id = ? and id_hash != ?`, userID, keep); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `delete from api_token where user_id = ?`, userID)
+	return err
+}
 
-	return post, nil
+func (p *persistence) UpdateProfile(ctx context.Context, u *user, displayName, bio string) error {
+	_, err := p.Database.ExecContext(ctx,
+		`update users set display_name = ?, bio = ? where id = ?`, displayName, bio, u.ID)
+	return err
+}
+
+// CreatePasswordReset makes a one time reset link secret for the
+// user, good until expires
+func (p *persistence) CreatePasswordReset(ctx context.Context, u *user, now, expires time.Time) (string, error) {
+	secret, err := newResetSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = p.Database.ExecContext(ctx, `insert into password_reset
+        (user_id, token_hash, created, expires) values (?, ?, ?, ?)`,
+		u.ID, hashToken(secret), now.Unix(), expires.Unix())
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// GetPasswordReset finds the user an unused, unexpired reset secret
+// is for
+func (p persistence) GetPasswordReset(ctx context.Context, secret string, now time.Time) (*user, error) {
+	var userID int
+	err := p.Reader.QueryRowContext(ctx, `select user_id from password_reset
+        where token_hash = ? and used = 0 and expires > ?`,
+		hashToken(secret), now.Unix()).Scan(&userID)
+	if err != nil {
+		return nil, lookupError("reset link", err)
+	}
+	return p.getUserByID(ctx, userID)
+}
+
+// UsePasswordReset sets the password if the secret is still good.
+// every outstanding link for the user is used up along with it, and
+// all their sessions and API tokens are revoked.
+func (p *persistence) UsePasswordReset(ctx context.Context, secret, password string, now time.Time) (*user, error) {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `select user_id from password_reset
+        where token_hash = ? and used = 0 and expires > ?`,
+		hashToken(secret), now.Unix()).Scan(&userID)
+	if err != nil {
+		return nil, lookupError("reset link", err)
+	}
+	_, err = tx.ExecContext(ctx, `update password_reset set used = ? where user_id = ? and used = 0`,
+		now.Unix(), userID)
+	if err != nil {
+		return nil, err
+	}
+	var u user
+	_, err = tx.ExecContext(ctx,
+		`update users set password = ?, failed_logins = 0, locked_until = 0 where id = ?`,
+		u.SetPassword(password), userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := revokeCredentials(ctx, tx, userID, ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return p.getUserByID(ctx, userID)
+}
+
+// StartTOTP saves a new secret for a user setting up two factor
+// auth. it isn't checked at login until EnableTOTP.
+func (p *persistence) StartTOTP(ctx context.Context, u *user, secret string) error {
+	res, err := p.Database.ExecContext(ctx,
+		`update users set totp_secret = ? where id = ? and totp_enabled = 0`, secret, u.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return conflict("two factor authentication is already on", nil)
+	}
+	return nil
+}
+
+// EnableTOTP turns two factor auth on once the user has shown a
+// working code, and replaces any old recovery codes
+func (p *persistence) EnableTOTP(ctx context.Context, u *user, step int64, codeHashes []string) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `update users set totp_enabled = 1, totp_last_step = ?
+        where id = ? and totp_enabled = 0 and totp_secret != ''`, step, u.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return conflict("two factor authentication is already on", nil)
+	}
+	if _, err := tx.ExecContext(ctx, `delete from recovery_code where user_id = ?`, u.ID); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		_, err := tx.ExecContext(ctx,
+			`insert into recovery_code (user_id, code_hash) values (?, ?)`, u.ID, h)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *persistence) DisableTOTP(ctx context.Context, u *user) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = '', totp_enabled = 0,
+        totp_last_step = 0 where id = ?`, u.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from recovery_code where user_id = ?`, u.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code for the step has been accepted.
+// it's false if that step, or a later one, was already used.
+func (p *persistence) UseTOTPStep(ctx context.Context, u *user, step int64) (bool, error) {
+	res, err := p.Database.ExecContext(ctx,
+		`update users set totp_last_step = ? where id = ? and totp_last_step < ?`,
+		step, u.ID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode marks a recovery code as used. it's false if the
+// user has no unused code with that hash.
+func (p *persistence) UseRecoveryCode(ctx context.Context, u *user, codeHash string, now time.Time) (bool, error) {
+	res, err := p.Database.ExecContext(ctx, `update recovery_code set used = ?
+        where user_id = ? and code_hash = ? and used = 0`, now.Unix(), u.ID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (p persistence) CountRecoveryCodes(ctx context.Context, u user) (int, error) {
+	var n int
+	err := p.Reader.QueryRowContext(ctx,
+		`select count(*) from recovery_code where user_id = ? and used = 0`, u.ID).Scan(&n)
+	return n, err
+}
+
+// CreateInvite saves a new invite code, by its hash
+func (p *persistence) CreateInvite(ctx context.Context, u *user, codeHash string, maxUses int, now, expires time.Time) (*invite, error) {
+	r, err := p.Database.ExecContext(ctx, `insert into invite
+        (created_by, code_hash, max_uses, created, expires) values (?, ?, ?, ?, ?)`,
+		u.ID, codeHash, maxUses, now.Unix(), expires.Unix())
+	if err != nil {
+		return nil, err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &invite{ID: int(id), MaxUses: maxUses, Created: int(now.Unix()), Expires: int(expires.Unix())}, nil
+}
+
+func (p persistence) GetUserInvites(ctx context.Context, u user) ([]*invite, error) {
+	rows, err := p.Reader.QueryContext(ctx, `select id, max_uses, uses, created, expires
+        from invite where created_by = ? order by created desc, id desc`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invites []*invite
+	for rows.Next() {
+		var i invite
+		if err := rows.Scan(&i.ID, &i.MaxUses, &i.Uses, &i.Created, &i.Expires); err != nil {
+			return nil, err
+		}
+		invites = append(invites, &i)
+	}
+	return invites, rows.Err()
+}
+
+func (p *persistence) DeleteInvite(ctx context.Context, u user, id int) error {
+	res, err := p.Database.ExecContext(ctx,
+		`delete from invite where id = ? and created_by = ?`, id, u.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return notFound("invite", nil)
+	}
+	return nil
+}
+
+// CreateInvitedUser uses up one use of the invite and creates the
+// user, or does neither
+func (p *persistence) CreateInvitedUser(ctx context.Context, username, password, codeHash string, now time.Time) (*user, error) {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id, inviter int
+	err = tx.QueryRowContext(ctx, `select id, created_by from invite
+        where code_hash = ? and expires > ? and uses < max_uses`,
+		codeHash, now.Unix()).Scan(&id, &inviter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, invalidFields(map[string]string{
+			"invite": "that invite code isn't valid, or has expired or been used up"})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `update invite set uses = uses + 1 where id = ?`, id); err != nil {
+		return nil, err
+	}
+	u, err := insertUser(ctx, tx, username, password, &inviter)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetInvitees lists the users who registered with the user's invites
+func (p persistence) GetInvitees(ctx context.Context, u user) ([]string, error) {
+	rows, err := p.Reader.QueryContext(ctx,
+		`select username from users where invited_by = ? order by username`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GetUsers lists users, newest first
+func (p persistence) GetUsers(ctx context.Context, limit, offset int) ([]*user, error) {
+	rows, err := p.Reader.QueryContext(ctx, userSelect+` order by u.id desc limit ? offset ?`,
+		limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*user
+	for rows.Next() {
+		u, err := scanUserRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GetRecentChannels lists the newest channels across every user
+func (p persistence) GetRecentChannels(ctx context.Context, limit int) ([]*channel, error) {
+	rows, err := p.Reader.QueryContext(ctx, `select c.id, c.slug, c.label, u.username
+        from channel c join users u on u.id = c.user_id order by c.id desc limit ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var channels []*channel
+	for rows.Next() {
+		c := &channel{User: &user{}}
+		if err := rows.Scan(&c.ID, &c.Slug, &c.Label, &c.User.Username); err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+func (p *persistence) SetAdmin(ctx context.Context, u *user, admin bool) error {
+	_, err := p.Database.ExecContext(ctx, `update users set is_admin = ? where id = ?`, admin, u.ID)
+	return err
+}
+
+func (p *persistence) SetDisabled(ctx context.Context, u *user, disabled bool) error {
+	_, err := p.Database.ExecContext(ctx, `update users set disabled = ? where id = ?`, disabled, u.ID)
+	return err
+}
+
+// GetSetting is "" for a setting that has never been changed
+func (p persistence) GetSetting(ctx context.Context, name string) (string, error) {
+	var value string
+	err := p.Reader.QueryRowContext(ctx,
+		`select value from site_setting where name = ?`, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return value, err
+}
+
+func (p *persistence) SetSetting(ctx context.Context, name, value string) error {
+	_, err := p.Database.ExecContext(ctx, `insert into site_setting (name, value) values (?, ?)
+        on conflict (name) do update set value = excluded.value`, name, value)
+	return err
+}
+
+// DeleteUser removes the user and everything they made, or nothing
+// if any part of it fails. the search index and the tables from
+// before foreign keys are cleared by hand; the rest cascades.
+func (p *persistence) DeleteUser(ctx context.Context, u *user) error {
+	tx, err := p.Database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := []string{
+		`delete from post_fts where rowid in (select id from post where user_id = ?)`,
+		`delete from postchannel where post_id in (select id from post where user_id = ?)
+            or channel_id in (select id from channel where user_id = ?)`,
+		`delete from post_revision where post_id in (select id from post where user_id = ?)`,
+		`delete from post where user_id = ?`,
+		`delete from channel where user_id = ?`,
+		`delete from api_token where user_id = ?`,
+	}
+	for _, q := range stmts {
+		args := make([]interface{}, strings.Count(q, "?"))
+		for i := range args {
+			args[i] = u.ID
+		}
+		if _, err := tx.ExecContext(ctx, q, args...); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `delete from login_attempt where username = ?`, u.Username); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `delete from users where id = ?`, u.ID)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res); err != nil {
+		return lookupError("user", err)
+	}
+	return tx.Commit()
+}
+
+const sessionSelect = `select s.id_hash, coalesce(u.username, ''), s.data, s.user_agent, s.ip,
+    s.created, s.last_seen, s.expires
+    from session s left join users u on u.id = s.user_id`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*userSession, error) {
+	var us userSession
+	err := row.Scan(&us.IDHash, &us.Username, &us.Data, &us.UserAgent, &us.IP,
+		&us.Created, &us.LastSeen, &us.Expires)
+	return &us, err
+}
+
+// GetSession finds an unexpired session by the hash of its id
+func (p persistence) GetSession(ctx context.Context, idHash string, now time.Time) (*userSession, error) {
+	row := p.Reader.QueryRowContext(ctx, sessionSelect+` where s.id_hash = ? and s.expires > ?`,
+		idHash, now.Unix())
+	us, err := scanSession(row)
+	if err != nil {
+		return nil, lookupError("session", err)
+	}
+	return us, nil
+}
+
+// GetUserSessions lists a user's unexpired sessions, most recently
+// used first
+func (p persistence) GetUserSessions(ctx context.Context, u user, now time.Time) ([]*userSession, error) {
+	rows, err := p.Reader.QueryContext(ctx, sessionSelect+` where s.user_id = ? and s.expires > ?
+        order by s.last_seen desc`, u.ID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []*userSession
+	for rows.Next() {
+		us, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, us)
+	}
+	return sessions, rows.Err()
+}
+
+// SaveSession writes a session, creating it if it's new. the owner
+// is whoever is logged in, if anyone.
+func (p *persistence) SaveSession(ctx context.Context, us userSession) error {
+	_, err := p.Database.ExecContext(ctx, `insert into session
+        (id_hash, user_id, data, user_agent, ip, created, last_seen, expires)
+        values (?, (select id from users where username = ?), ?, ?, ?, ?, ?, ?)
+        on conflict (id_hash) do update set user_id = excluded.user_id,
+        data = excluded.data, user_agent = excluded.user_agent, ip = excluded.ip,
+        last_seen = excluded.last_seen, expires = excluded.expires`,
+		us.IDHash, us.Username, us.Data, us.UserAgent, us.IP, us.Created, us.LastSeen, us.Expires)
+	return err
+}
+
+// TouchSession records that a session is still in use
+func (p *persistence) TouchSession(ctx context.Context, us userSession) error {
+	_, err := p.Database.ExecContext(ctx, `update session set last_seen = ?, user_agent = ?, ip = ?
+        where id_hash = ?`, us.LastSeen, us.UserAgent, us.IP, us.IDHash)
+	return err
+}
+
+func (p *persistence) DeleteSession(ctx context.Context, idHash string) error {
+	_, err := p.Database.ExecContext(ctx, `delete from session where id_hash = ?`, idHash)
+	return err
+}
+
+// DeleteOtherSessions logs a user out everywhere except the session
+// they're using, returning how many went
+func (p *persistence) DeleteOtherSessions(ctx context.Context, u user, keep string) (int, error) {
+	res, err := p.Database.ExecContext(ctx, `delete from session where user_id = ? and id_hash != ?`,
+		u.ID, keep)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (p *persistence) DeleteExpiredSessions(ctx context.Context, now time.Time) (int, error) {
+	res, err := p.Database.ExecContext(ctx, `delete from session where expires <= ?`, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
 }
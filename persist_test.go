@@ -1,32 +1,52 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// TestMain stops before running anything if sqlite lacks FTS5, with
+// one message saying how to build it rather than a failure from
+// every test that touches the database
+func TestMain(m *testing.M) {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	if err == nil {
+		err = checkFTS5(db)
+		db.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
 func setupTestDB(t *testing.T) (*persistence, func()) {
 	// Create an in-memory SQLite database for testing
-	db, err := sql.Open("sqlite3", "file::memory:?cache=shared")
+	db, err := sql.Open(sqliteDriver, "file::memory:?cache=shared&_foreign_keys=on")
 	if err != nil {
 		t.Fatalf("Failed to open test database: %v", err)
 	}
-
-	// Read and execute schema.sql
-	schema, err := os.ReadFile("schema.sql")
-	if err != nil {
-		t.Fatalf("Failed to read schema.sql: %v", err)
+	if err := checkFTS5(db); err != nil {
+		t.Fatal(err)
 	}
 
-	_, err = db.Exec(string(schema))
-	if err != nil {
-		t.Fatalf("Failed to execute schema.sql: %v", err)
-	}
+	// a shared in-memory database can't be opened read only, so
+	// reads and writes share a pool here
+	p := &persistence{Database: db, Reader: db}
 
-	p := &persistence{Database: db}
+	// bring the schema up to date
+	if _, err := p.Migrate(context.Background(), false); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
 
 	cleanup := func() {
 		p.Close()
@@ -35,12 +55,25 @@ func setupTestDB(t *testing.T) (*persistence, func()) {
 	return p, cleanup
 }
 
+// setupFileDB makes a real database file so the read pool and WAL
+// mode can be exercised
+func setupFileDB(tb testing.TB) (*persistence, func()) {
+	p, err := newPersistence(filepath.Join(tb.TempDir(), "finch.db"))
+	if err != nil {
+		tb.Fatalf("Failed to open test database: %v", err)
+	}
+	if _, err := p.Migrate(context.Background(), false); err != nil {
+		tb.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return p, p.Close
+}
+
 func TestPersistenceUser(t *testing.T) {
 	p, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	// Test CreateUser
-	u, err := p.CreateUser("testuser", "password123")
+	u, err := p.CreateUser(context.Background(), "testuser", "password123")
 	if err != nil {
 		t.Fatalf("CreateUser failed: %v", err)
 	}
@@ -49,7 +82,7 @@ func TestPersistenceUser(t *testing.T) {
 	}
 
 	// Test GetUser
-	fetchedUser, err := p.GetUser("testuser")
+	fetchedUser, err := p.GetUser(context.Background(), "testuser")
 	if err != nil {
 		t.Fatalf("GetUser failed: %v", err)
 	}
@@ -68,14 +101,14 @@ func TestPersistenceChannelsAndPosts(t *testing.T) {
 	defer cleanup()
 
 	// Create user
-	u, err := p.CreateUser("testuser", "password")
+	u, err := p.CreateUser(context.Background(), "testuser", "password")
 	if err != nil {
 		t.Fatalf("CreateUser failed: %v", err)
 	}
 
 	// Create channels
 	names := []string{"General", "Random Thoughts"}
-	channels, err := p.AddChannels(*u, names)
+	channels, err := p.AddChannels(context.Background(), *u, names)
 	if err != nil {
 		t.Fatalf("AddChannels failed: %v", err)
 	}
@@ -84,7 +117,7 @@ func TestPersistenceChannelsAndPosts(t *testing.T) {
 	}
 
 	// Get user channels
-	userChannels, err := p.GetUserChannels(*u)
+	userChannels, err := p.GetUserChannels(context.Background(), *u)
 	if err != nil {
 		t.Fatalf("GetUserChannels failed: %v", err)
 	}
@@ -94,7 +127,7 @@ func TestPersistenceChannelsAndPosts(t *testing.T) {
 
 	// Create post with channels
 	body := "Hello world in two channels"
-	post, err := p.AddPost(*u, body, channels)
+	post, err := p.AddPost(context.Background(), *u, body, channels)
 	if err != nil {
 		t.Fatalf("AddPost failed: %v", err)
 	}
@@ -104,7 +137,7 @@ func TestPersistenceChannelsAndPosts(t *testing.T) {
 	}
 
 	// Get post by UUID
-	fetchedPost, err := p.GetPostByUUID(post.UUID)
+	fetchedPost, err := p.GetPostByUUID(context.Background(), post.UUID)
 	if err != nil {
 		t.Fatalf("GetPostByUUID failed: %v", err)
 	}
@@ -113,7 +146,7 @@ func TestPersistenceChannelsAndPosts(t *testing.T) {
 	}
 
 	// Get all posts
-	posts, err := p.GetAllPosts(10, 0)
+	posts, err := p.GetAllPosts(context.Background(), 10, 0)
 	if err != nil {
 		t.Fatalf("GetAllPosts failed: %v", err)
 	}
@@ -125,13 +158,153 @@ func TestPersistenceChannelsAndPosts(t *testing.T) {
 	}
 
 	// Test DeletePost
-	err = p.DeletePost(post)
+	err = p.DeletePost(context.Background(), post)
 	if err != nil {
 		t.Fatalf("DeletePost failed: %v", err)
 	}
 
-	postsAfterDelete, _ := p.GetAllPosts(10, 0)
+	postsAfterDelete, _ := p.GetAllPosts(context.Background(), 10, 0)
 	if len(postsAfterDelete) != 0 {
 		t.Errorf("Expected 0 posts after deletion, got %d", len(postsAfterDelete))
 	}
 }
+
+// failOn installs a trigger that aborts matching inserts into
+// table, so a write can be made to fail part way through
+func failOn(t *testing.T, p *persistence, table, when string) func() {
+	t.Helper()
+	q := `CREATE TRIGGER fail_` + table + ` BEFORE INSERT ON ` + table +
+		` WHEN ` + when + ` BEGIN SELECT RAISE(ABORT, 'injected failure'); END`
+	if _, err := p.Database.Exec(q); err != nil {
+		t.Fatalf("creating trigger failed: %v", err)
+	}
+	return func() { p.Database.Exec(`DROP TRIGGER fail_` + table) }
+}
+
+func countRows(t *testing.T, p *persistence, table string) int {
+	t.Helper()
+	var n int
+	if err := p.Database.QueryRow(`select count(*) from ` + table).Scan(&n); err != nil {
+		t.Fatalf("counting %s failed: %v", table, err)
+	}
+	return n
+}
+
+func TestAddPostRollsBack(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	u, _ := p.CreateUser(context.Background(), "atomic", "password")
+	channels, _ := p.AddChannels(context.Background(), *u, []string{"one", "two"})
+
+	// the second channel association fails after the post, its
+	// index entry and the first association went in
+	undo := failOn(t, p, "postchannel", "NEW.channel_id = "+strconv.Itoa(channels[1].ID))
+	_, err := p.AddPost(context.Background(), *u, "half written", channels)
+	undo()
+	if err == nil {
+		t.Fatal("expected AddPost to fail")
+	}
+	for _, table := range []string{"post", "post_fts", "postchannel"} {
+		if n := countRows(t, p, table); n != 0 {
+			t.Errorf("expected %s to be rolled back, found %d rows", table, n)
+		}
+	}
+
+	// and the writer is free for the next one
+	if _, err := p.AddPost(context.Background(), *u, "whole", channels); err != nil {
+		t.Errorf("AddPost after a rollback failed: %v", err)
+	}
+}
+
+func TestAddChannelsRollsBack(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	u, _ := p.CreateUser(context.Background(), "atomic", "password")
+
+	undo := failOn(t, p, "channel", "NEW.label = 'bad'")
+	_, err := p.AddChannels(context.Background(), *u, []string{"good", "bad"})
+	undo()
+	if err == nil {
+		t.Fatal("expected AddChannels to fail")
+	}
+	if n := countRows(t, p, "channel"); n != 0 {
+		t.Errorf("expected no channels after a rollback, found %d", n)
+	}
+}
+
+func TestAddPostRollsBackNewChannels(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	u, _ := p.CreateUser(context.Background(), "atomic", "password")
+
+	// the channel goes in with the post, so when the post can't
+	// neither does the channel
+	undo := failOn(t, p, "postchannel", "1")
+	_, err := p.AddPost(context.Background(), *u, "half written", []*channel{newChannel(*u, "fresh")})
+	undo()
+	if err == nil {
+		t.Fatal("expected AddPost to fail")
+	}
+	for _, table := range []string{"post", "channel", "postchannel"} {
+		if n := countRows(t, p, table); n != 0 {
+			t.Errorf("expected %s to be rolled back, found %d rows", table, n)
+		}
+	}
+
+	post, err := p.AddPost(context.Background(), *u, "whole", []*channel{newChannel(*u, "fresh")})
+	if err != nil {
+		t.Fatalf("AddPost failed: %v", err)
+	}
+	channels, _ := p.GetPostChannels(context.Background(), post)
+	if len(channels) != 1 || channels[0].Slug != "fresh" {
+		t.Errorf("expected the post in the new channel, got %+v", channels)
+	}
+}
+
+func TestCreateUserConflict(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	if _, err := p.CreateUser(context.Background(), "taken", "password"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	_, err := p.CreateUser(context.Background(), "taken", "different")
+	if !errors.Is(err, errConflict) {
+		t.Errorf("expected a conflict for a duplicate username, got %v", err)
+	}
+	u, _ := p.GetUser(context.Background(), "taken")
+	if !u.CheckPassword("password") {
+		t.Error("the duplicate overwrote the original user")
+	}
+}
+
+func TestDeletesCascade(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	ctx := context.Background()
+	u, _ := p.CreateUser(ctx, "cascade", "password")
+	channels, _ := p.AddChannels(ctx, *u, []string{"one", "two"})
+	post, _ := p.AddPost(ctx, *u, "first", channels)
+	p.UpdatePost(ctx, post, "second", channels)
+
+	if err := p.DeleteChannel(ctx, channels[0]); err != nil {
+		t.Fatalf("DeleteChannel failed: %v", err)
+	}
+	if n := countRows(t, p, "postchannel"); n != 1 {
+		t.Errorf("expected deleting a channel to drop its memberships, %d left", n)
+	}
+
+	if err := p.DeletePost(ctx, post); err != nil {
+		t.Fatalf("DeletePost failed: %v", err)
+	}
+	for _, table := range []string{"postchannel", "post_revision", "post_fts"} {
+		if n := countRows(t, p, table); n != 0 {
+			t.Errorf("expected deleting a post to clear %s, found %d rows", table, n)
+		}
+	}
+
+	// and the keys are enforced
+	_, err := p.Database.Exec(`insert into postchannel (post_id, channel_id) values (999, 999)`)
+	if err == nil {
+		t.Error("expected a foreign key violation")
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"html/template"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/russross/blackfriday"
 )
 
@@ -14,10 +17,43 @@ type post struct {
 	Body     string
 	Posted   int
 	Channels []*channel
+	// matching excerpt, only set on search results
+	Snippet string
 }
 
+// RenderBody is the post as HTML for templates to include as is.
+// it's only trusted because it has been through sanitizeHTML.
 func (p post) RenderBody() template.HTML {
-	return template.HTML(string(blackfriday.MarkdownCommon([]byte(p.Body))))
+	return template.HTML(sanitizeHTML(blackfriday.MarkdownCommon([]byte(p.Body))))
+}
+
+// bodyPolicy allows what markdown produces and nothing else. in
+// particular, raw html in a post can't bring in scripts, event
+// handlers, styles or javascript: links.
+var bodyPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6",
+		"blockquote", "pre", "code", "em", "strong", "del", "sup", "sub",
+		"ul", "ol", "li", "dl", "dt", "dd",
+		"table", "thead", "tbody", "tr", "th", "td")
+	p.AllowAttrs("href", "title").OnElements("a")
+	p.AllowAttrs("src", "alt", "title").OnElements("img")
+	p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|right|center)$`)).OnElements("th", "td")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.AllowRelativeURLs(true)
+	p.RequireParseableURLs(true)
+	p.RequireNoFollowOnLinks(true)
+	return p
+}()
+
+// sanitizeHTML cleans rendered markdown with bodyPolicy. the
+// policy has no option for noopener without also opening links in
+// a new tab, so it's added here. posts can't set rel themselves,
+// so every rel in the output is one the policy put there.
+func sanitizeHTML(unsafe []byte) string {
+	clean := bodyPolicy.SanitizeBytes(unsafe)
+	return strings.ReplaceAll(string(clean), `rel="nofollow"`, `rel="nofollow noopener"`)
 }
 
 func (p post) URL() string {
@@ -27,3 +63,7 @@ func (p post) URL() string {
 func (p post) Time() time.Time {
 	return time.Unix(int64(p.Posted), 0)
 }
+
+func (p post) RenderSnippet() template.HTML {
+	return renderSnippet(p.Snippet)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"html/template"
+	"strings"
 	"testing"
 	"time"
 )
@@ -40,3 +41,82 @@ func TestPost(t *testing.T) {
 		t.Errorf("Time expected %v, got %v", expectedTime, p.Time())
 	}
 }
+
+// payloads that have gotten through markdown renderers and naive
+// sanitizers one way or another
+var xssPayloads = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=//evil.example/x.js></SCRIPT>`,
+	`<img src=x onerror=alert(1)>`,
+	`<img src="javascript:alert(1)">`,
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<iframe src="https://evil.example/"></iframe>`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`<a href="JaVaScRiPt:alert(1)">click</a>`,
+	`<a href="jav&#x09;ascript:alert(1)">click</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`,
+	`<a href="vbscript:msgbox(1)">click</a>`,
+	`[click](javascript:alert(1))`,
+	`[click](javascript&#58;alert(1))`,
+	`![x](javascript:alert(1))`,
+	`![x](x" onerror="alert(1))`,
+	`[x](https://example.com" onmouseover="alert(1))`,
+	`<div style="background:url(javascript:alert(1))">x</div>`,
+	`<p style="x:expression(alert(1))">x</p>`,
+	`<body onload=alert(1)>`,
+	`<form action="javascript:alert(1)"><input type=submit></form>`,
+	`<object data="https://evil.example/x.swf"></object>`,
+	`<embed src="https://evil.example/x.swf">`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="https://evil.example/">`,
+	`<link rel="stylesheet" href="https://evil.example/x.css">`,
+	`<style>body{display:none}</style>`,
+	`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<details open ontoggle=alert(1)>`,
+	`<a href="https://example.com" rel="opener" target="_self">x</a>`,
+	"```\n</code></pre><script>alert(1)</script>\n```",
+	"<code class=\"x\" onclick=\"alert(1)\">x</code>",
+	`<table><td align="left" onmouseover="alert(1)">x</td></table>`,
+}
+
+func TestRenderBodySanitizes(t *testing.T) {
+	bad := []string{"<script", "onerror", "onload", "onclick", "onmouseover", "ontoggle",
+		"javascript:", "vbscript:", "data:", "<iframe", "<svg", "<style", "style=",
+		"<object", "<embed", "<meta", "<base", "<link", "<form", "<input", "<body",
+		"target=", `rel="opener"`}
+	for _, payload := range xssPayloads {
+		out := strings.ToLower(string(post{Body: payload}.RenderBody()))
+		for _, b := range bad {
+			if strings.Contains(out, b) {
+				t.Errorf("%q rendered as %q, which contains %q", payload, out, b)
+			}
+		}
+	}
+}
+
+func TestRenderBodyKeepsMarkdown(t *testing.T) {
+	body := "# Title\n\n" +
+		"some *em* and ~~del~~ and a [link](https://example.com/) and <http://example.org/>\n\n" +
+		"![cat](/media/cat.png)\n\n" +
+		"| a | b |\n|:--|--:|\n| 1 | 2 |\n\n" +
+		"```go\nfmt.Println(\"<hi>\")\n```\n"
+	out := string(post{Body: body}.RenderBody())
+	for _, want := range []string{
+		"<h1>Title</h1>",
+		"<em>em</em>",
+		"<del>del</del>",
+		`<a href="https://example.com/" rel="nofollow noopener">link</a>`,
+		`<a href="http://example.org/" rel="nofollow noopener">`,
+		`<img src="/media/cat.png" alt="cat"`,
+		`<th align="left">a</th>`,
+		`<td align="right">2</td>`,
+		`<code class="language-go">`,
+		"&lt;hi&gt;",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// newResetSecret is the random part of a reset link. like API
+// tokens, only its hash is stored.
+func newResetSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type resetResponse struct {
+	Username string
+	Error    string
+	Errors   map[string]string
+	siteResponse
+}
+
+func resetFormHandler(s *site) http.Handler {
+	tmpl := getTemplate("reset.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			u, err := s.GetResetUser(r.Context(), r.PathValue("token"))
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			rr := resetResponse{Username: u.Username}
+			ctx.PopulateResponse(&rr)
+			render(w, ctx, tmpl, http.StatusOK, rr)
+		})
+}
+
+func resetHandler(s *site) http.Handler {
+	tmpl := getTemplate("reset.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			secret := r.PathValue("token")
+			u, err := s.ResetPassword(r.Context(), secret,
+				r.FormValue("password"), r.FormValue("confirm"))
+			if errors.Is(err, errValidation) {
+				// show the form again, as long as the link is still good
+				ru, lerr := s.GetResetUser(r.Context(), secret)
+				if lerr != nil {
+					renderError(w, ctx, lerr)
+					return
+				}
+				rr := resetResponse{Username: ru.Username, Errors: fieldErrors(err)}
+				if rr.Errors == nil {
+					rr.Error = errorMessage(err)
+				}
+				ctx.PopulateResponse(&rr)
+				render(w, ctx, tmpl, http.StatusUnprocessableEntity, rr)
+				return
+			}
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+
+			// a reset is as good as a password, so two factor
+			// auth still needs the code
+			if u.TOTPEnabled {
+				if err := awaitSecondFactor(s, w, r, u.Username); err != nil {
+					renderError(w, ctx, err)
+					return
+				}
+				http.Redirect(w, r, "/login/verify/", http.StatusFound)
+				return
+			}
+			if err := logIn(s, w, r, u.Username); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/", http.StatusFound)
+		})
+}
+
+// runResetLink is the reset-link command, for handing a user who
+// is locked out of their account a way back in
+func runResetLink(ctx context.Context, s *site, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("usage: finch reset-link <username>")
+	}
+	u, err := s.GetUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	link, err := s.CreateResetLink(ctx, *u)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, link)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a revision is the body of a post as it was before an edit
+type revision struct {
+	ID     int
+	Post   *post
+	Body   string
+	Edited int
+}
+
+func (r revision) Time() time.Time {
+	return time.Unix(int64(r.Edited), 0)
+}
+
+type diffLine struct {
+	// one of "+", "-" or " "
+	Op   string
+	Text string
+}
+
+func (d diffLine) Added() bool   { return d.Op == "+" }
+func (d diffLine) Removed() bool { return d.Op == "-" }
+
+// maxDiffCells bounds the LCS table. past it the changed middle
+// of the two bodies is shown as removed then added rather than
+// lined up.
+const maxDiffCells = 250000
+
+// diffLines does a simple LCS based line diff. lines the two share
+// at the start and end are matched up first, so the table is only
+// as big as the part that changed.
+func diffLines(before, after string) []diffLine {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	var out []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		out = append(out, diffLine{Op: " ", Text: a[0]})
+		a, b = a[1:], b[1:]
+	}
+	var tail []diffLine
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		tail = append(tail, diffLine{Op: " ", Text: a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	out = append(out, diffMiddle(a, b)...)
+	for i := len(tail) - 1; i >= 0; i-- {
+		out = append(out, tail[i])
+	}
+	return out
+}
+
+func diffMiddle(a, b []string) []diffLine {
+	var out []diffLine
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, l := range a {
+			out = append(out, diffLine{Op: "-", Text: l})
+		}
+		for _, l := range b {
+			out = append(out, diffLine{Op: "+", Text: l})
+		}
+		return out
+	}
+
+	// lcs[i][j] is the length of the longest common
+	// subsequence of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			out = append(out, diffLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{Op: "-", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{Op: "+", Text: b[j]})
+	}
+	return out
+}
+
+// diffCache keeps diffs that have already been worked out. they're
+// keyed by what was diffed, so an entry can never go stale; the
+// whole thing is just dropped when it fills up.
+type diffCache struct {
+	mu   sync.Mutex
+	size int
+	m    map[[sha256.Size]byte][]diffLine
+}
+
+func newDiffCache(size int) *diffCache {
+	return &diffCache{size: size, m: make(map[[sha256.Size]byte][]diffLine)}
+}
+
+// diff is diffLines, remembered. a nil cache just diffs.
+func (c *diffCache) diff(before, after string) []diffLine {
+	if c == nil {
+		return diffLines(before, after)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s%s", len(before), before, after)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	c.mu.Lock()
+	d, ok := c.m[key]
+	c.mu.Unlock()
+	if ok {
+		return d
+	}
+	d = diffLines(before, after)
+	c.mu.Lock()
+	if len(c.m) >= c.size {
+		clear(c.m)
+	}
+	c.m[key] = d
+	c.mu.Unlock()
+	return d
+}
+
+// revisionDiff pairs a revision with the changes made to it
+type revisionDiff struct {
+	*revision
+	Diff []diffLine
+}
+
+// historyFor builds the diffs between each revision and the
+// version that replaced it, newest first
+func historyFor(diffs *diffCache, p *post, revisions []*revision) []revisionDiff {
+	var history []revisionDiff
+	for i := len(revisions) - 1; i >= 0; i-- {
+		next := p.Body
+		if i+1 < len(revisions) {
+			next = revisions[i+1].Body
+		}
+		history = append(history, revisionDiff{
+			revision: revisions[i],
+			Diff:     diffs.diff(revisions[i].Body, next),
+		})
+	}
+	return history
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines("one\ntwo\nthree", "one\n2\nthree\nfour")
+	want := []diffLine{
+		{Op: " ", Text: "one"},
+		{Op: "-", Text: "two"},
+		{Op: "+", Text: "2"},
+		{Op: " ", Text: "three"},
+		{Op: "+", Text: "four"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffLines expected %v, got %v", want, got)
+	}
+
+	same := diffLines("a\nb", "a\nb")
+	for _, d := range same {
+		if d.Added() || d.Removed() {
+			t.Errorf("identical bodies should have no changes, got %v", same)
+		}
+	}
+}
+
+func TestDiffLinesLargeBodies(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 2000; i++ {
+		a = append(a, fmt.Sprintf("old %d", i))
+		b = append(b, fmt.Sprintf("new %d", i))
+	}
+	before := "top\n" + strings.Join(a, "\n") + "\nbottom"
+	after := "top\n" + strings.Join(b, "\n") + "\nbottom"
+	// too big to line up, so the middle is all removed then added
+	got := diffLines(before, after)
+	if len(got) != 4002 {
+		t.Fatalf("expected 4002 lines, got %d", len(got))
+	}
+	if got[0].Text != "top" || got[0].Op != " " || got[len(got)-1].Text != "bottom" || got[len(got)-1].Op != " " {
+		t.Errorf("expected the shared ends to be kept, got %v and %v", got[0], got[len(got)-1])
+	}
+	if !got[1].Removed() || !got[2000].Removed() || !got[2001].Added() {
+		t.Errorf("expected removals then additions, got %v %v %v", got[1], got[2000], got[2001])
+	}
+}
+
+func TestDiffCache(t *testing.T) {
+	c := newDiffCache(2)
+	first := c.diff("a\nb", "a\nc")
+	if !reflect.DeepEqual(first, diffLines("a\nb", "a\nc")) {
+		t.Errorf("cached diff differs: %v", first)
+	}
+	if again := c.diff("a\nb", "a\nc"); &again[0] != &first[0] {
+		t.Error("expected the second diff to come from the cache")
+	}
+	// same concatenation, different split
+	if d := c.diff("a\nba", "\nc"); reflect.DeepEqual(d, first) {
+		t.Error("different bodies should not share an entry")
+	}
+	c.diff("x", "y")
+	if len(c.m) > 2 {
+		t.Errorf("cache grew past its size: %d", len(c.m))
+	}
+}
+
+func TestPostBodyLimit(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	u, _ := s.CreateUser(context.Background(), "wordy", "password")
+
+	huge := strings.Repeat("x\n", maxPostBody/2+1)
+	if _, err := s.AddPost(context.Background(), *u, huge, nil); !errors.Is(err, errPostTooLong) {
+		t.Errorf("expected a too long post to be refused, got %v", err)
+	}
+	p, err := s.AddPost(context.Background(), *u, "short", nil)
+	if err != nil {
+		t.Fatalf("AddPost failed: %v", err)
+	}
+	if _, err := s.UpdatePost(context.Background(), p, huge, nil); !errors.Is(err, errPostTooLong) {
+		t.Errorf("expected a too long edit to be refused, got %v", err)
+	}
+	if errorStatus(errPostTooLong) != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", errorStatus(errPostTooLong))
+	}
+}
+
+func TestHistoryFor(t *testing.T) {
+	p := &post{Body: "v3"}
+	revisions := []*revision{
+		{ID: 1, Body: "v1", Edited: 1},
+		{ID: 2, Body: "v2", Edited: 2},
+	}
+	history := historyFor(nil, p, revisions)
+	if len(history) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(history))
+	}
+	// newest first, diffed against what replaced it
+	if history[0].ID != 2 || history[0].Diff[1].Text != "v3" {
+		t.Errorf("unexpected first entry %+v", history[0])
+	}
+	if history[1].ID != 1 || history[1].Diff[1].Text != "v2" {
+		t.Errorf("unexpected second entry %+v", history[1])
+	}
+}
+
+func TestPersistenceUpdatePost(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	u, _ := p.CreateUser(context.Background(), "editor", "password")
+	channels, _ := p.AddChannels(context.Background(), *u, []string{"First", "Second"})
+	original, err := p.AddPost(context.Background(), *u, "typo", channels[:1])
+	if err != nil {
+		t.Fatalf("AddPost failed: %v", err)
+	}
+
+	updated, err := p.UpdatePost(context.Background(), original, "fixed", channels[1:])
+	if err != nil {
+		t.Fatalf("UpdatePost failed: %v", err)
+	}
+	if updated.UUID != original.UUID || updated.Body != "fixed" {
+		t.Errorf("expected same post with new body, got %+v", updated)
+	}
+
+	postChannels, _ := p.GetPostChannels(context.Background(), updated)
+	if len(postChannels) != 1 || postChannels[0].Slug != "second" {
+		t.Errorf("expected channel membership to be replaced, got %+v", postChannels)
+	}
+
+	revisions, err := p.GetPostRevisions(context.Background(), updated)
+	if err != nil {
+		t.Fatalf("GetPostRevisions failed: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Body != "typo" {
+		t.Errorf("expected the original body as a revision, got %+v", revisions)
+	}
+}
+
+func TestEditPostHandler(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	u, _ := s.CreateUser(context.Background(), "editor", "password")
+	s.CreateUser(context.Background(), "someoneelse", "password")
+	p, _ := s.AddPost(context.Background(), *u, "first draft", nil)
+
+	form := url.Values{"body": {"second draft"}}
+	resp := formRequest(handler, p.URL()+"edit/", form, loginCookies(t, handler, "someoneelse", "password"))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 editing someone else's post, got %d", resp.StatusCode)
+	}
+
+	resp = formRequest(handler, p.URL()+"edit/", form, loginCookies(t, handler, "editor", "password"))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != p.URL() {
+		t.Errorf("expected redirect to %q, got %q", p.URL(), loc)
+	}
+
+	rr := apiRequest(handler, "GET", p.URL(), "", nil)
+	if !strings.Contains(rr.Body.String(), "edited") {
+		t.Error("expected the post page to show an edited marker")
+	}
+}
@@ -10,30 +10,81 @@ func addRoutes(
 	p *persistence,
 
 ) {
-	mux.Handle("/", indexHandler(s))
-	mux.HandleFunc("/healthz/", healthzHandler)
-	mux.Handle("GET /post/", postFormHandler(s))
-	mux.Handle("POST /post/", postHandler(s))
-	mux.Handle("/search/", searchHandler(s))
-
-	mux.Handle("GET /u/{username}/", userIndex(s))
-	mux.Handle("GET /u/{username}/feed/", userFeed(s))
-	mux.Handle("GET /u/{username}/p/{puuid}/", individualPostHandler(s))
-	mux.Handle("POST /u/{username}/p/{puuid}/delete/", postDelete(s))
-	mux.Handle("GET /u/{username}/c/{slug}/", channelIndex(s))
-	mux.Handle("GET /u/{username}/c/{slug}/feed/", channelFeed(s))
-	mux.Handle("POST /u/{username}/c/{slug}/delete/", channelDelete(s))
+	s.errorTmpl = getTemplate("error.html")
+
+	mux.Handle("GET /{$}", indexHandler(s))
+	mux.HandleFunc("/healthz/{$}", healthzHandler)
+	mux.Handle("GET /post/{$}", postFormHandler(s))
+	mux.Handle("POST /post/{$}", postHandler(s))
+	mux.Handle("/search/{$}", searchHandler(s))
+
+	mux.Handle("GET /u/{username}/{$}", userIndex(s))
+	mux.Handle("GET /u/{username}/feed/{$}", userFeed(s))
+	mux.Handle("GET /u/{username}/p/{puuid}/{$}", individualPostHandler(s))
+	mux.Handle("GET /u/{username}/p/{puuid}/edit/{$}", editPostFormHandler(s))
+	mux.Handle("POST /u/{username}/p/{puuid}/edit/{$}", editPostHandler(s))
+	mux.Handle("POST /u/{username}/p/{puuid}/delete/{$}", postDelete(s))
+	mux.Handle("GET /u/{username}/c/{slug}/{$}", channelIndex(s))
+	mux.Handle("GET /u/{username}/c/{slug}/feed/{$}", channelFeed(s))
+	mux.Handle("POST /u/{username}/c/{slug}/delete/{$}", channelDelete(s))
 
 	// authy stuff
-	mux.Handle("GET /register/", registerFormHandler(s))
-	mux.Handle("POST /register/", registerHandler(s))
-	mux.Handle("GET /login/", loginFormHandler(s))
-	mux.Handle("POST /login/", loginHandler(s))
-	mux.Handle("/logout/", logoutHandler(s))
+	mux.Handle("GET /register/{$}", registerFormHandler(s))
+	mux.Handle("POST /register/{$}", registerHandler(s))
+	mux.Handle("GET /login/{$}", loginFormHandler(s))
+	mux.Handle("POST /login/{$}", loginHandler(s))
+	mux.Handle("GET /login/verify/{$}", loginVerifyFormHandler(s))
+	mux.Handle("POST /login/verify/{$}", loginVerifyHandler(s))
+	mux.Handle("POST /logout/{$}", logoutHandler(s))
+
+	// settings
+	mux.Handle("GET /settings/{$}", settingsHandler(s))
+	mux.Handle("POST /settings/tokens/{$}", createTokenHandler(s))
+	mux.Handle("POST /settings/tokens/{id}/label/{$}", tokenLabelHandler(s))
+	mux.Handle("POST /settings/tokens/{id}/delete/{$}", tokenDeleteHandler(s))
+	mux.Handle("POST /settings/password/{$}", passwordHandler(s))
+	mux.Handle("POST /settings/profile/{$}", profileHandler(s))
+	mux.Handle("POST /settings/totp/{$}", totpStartHandler(s))
+	mux.Handle("POST /settings/totp/confirm/{$}", totpConfirmHandler(s))
+	mux.Handle("POST /settings/totp/disable/{$}", totpDisableHandler(s))
+	mux.Handle("POST /settings/invites/{$}", createInviteHandler(s))
+	mux.Handle("POST /settings/invites/{id}/delete/{$}", deleteInviteHandler(s))
+	mux.Handle("POST /settings/sessions/logout/{$}", logoutOtherSessionsHandler(s))
+	mux.Handle("GET /settings/delete/{$}", deleteAccountFormHandler(s))
+	mux.Handle("POST /settings/delete/{$}", deleteAccountHandler(s))
+	mux.Handle("GET /reset/{token}/{$}", resetFormHandler(s))
+	mux.Handle("POST /reset/{token}/{$}", resetHandler(s))
+
+	// admin
+	mux.Handle("GET /admin/{$}", adminHandler(s))
+	mux.Handle("POST /admin/users/{username}/disable/{$}", adminDisableHandler(s, true))
+	mux.Handle("POST /admin/users/{username}/enable/{$}", adminDisableHandler(s, false))
+	mux.Handle("POST /admin/users/{username}/reset/{$}", adminResetHandler(s))
+	mux.Handle("POST /admin/registration/{$}", adminRegistrationHandler(s))
+
+	// JSON API
+	mux.Handle("GET /api/v1/posts/{$}", apiAllPosts(s))
+	mux.Handle("POST /api/v1/posts/{$}", apiAddPost(s))
+	mux.Handle("GET /api/v1/posts/{puuid}/{$}", apiGetPost(s))
+	mux.Handle("PUT /api/v1/posts/{puuid}/{$}", apiUpdatePost(s))
+	mux.Handle("DELETE /api/v1/posts/{puuid}/{$}", apiDeletePost(s))
+	mux.Handle("GET /api/v1/posts/{puuid}/revisions/{$}", apiPostRevisions(s))
+	mux.Handle("POST /api/v1/channels/{$}", apiAddChannels(s))
+	mux.Handle("GET /api/v1/search/{$}", apiSearch(s))
+	mux.Handle("GET /api/v1/users/{username}/{$}", apiGetUser(s))
+	mux.Handle("GET /api/v1/users/{username}/posts/{$}", apiUserPosts(s))
+	mux.Handle("GET /api/v1/users/{username}/channels/{$}", apiUserChannels(s))
+	mux.Handle("GET /api/v1/users/{username}/channels/{slug}/{$}", apiGetChannel(s))
+	mux.Handle("DELETE /api/v1/users/{username}/channels/{slug}/{$}", apiDeleteChannel(s))
+	mux.Handle("GET /api/v1/users/{username}/channels/{slug}/posts/{$}", apiChannelPosts(s))
+	mux.HandleFunc("/api/", apiNotFound)
 
 	// static misc.
 	mux.HandleFunc("/favicon.ico", faviconHandler)
 	mux.Handle("/media/", http.StripPrefix("/media/",
-		http.FileServer(http.Dir(mediaDir))))
+		http.FileServerFS(assetFS(mediaDir, embeddedMedia, "media"))))
+
+	// everything else
+	mux.Handle("/", notFoundHandler(s))
 
 }
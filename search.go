@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// search uses sqlite's FTS5, which go-sqlite3 only compiles in with
+// the sqlite_fts5 build tag. ranking and snippets are FTS5's own
+// bm25() and snippet().
+
+var errInvalidSearch = errors.New("invalid search query")
+
+// markers snippet() wraps matched terms in. a post body can have
+// them too, so searchText takes them out of what's indexed, which
+// is what snippets come from. that makes them safe to swap for
+// markup after the rest of the snippet is escaped.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+var snippetMarkers = strings.NewReplacer(snippetStart, " ", snippetEnd, " ")
+
+// searchText is a post body as it goes into the search index. the
+// markers become spaces, which is how the tokenizer saw them anyway.
+func searchText(body string) string {
+	return snippetMarkers.Replace(body)
+}
+
+// renderSnippet escapes a snippet and highlights the matches
+func renderSnippet(snippet string) template.HTML {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, snippetStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, snippetEnd, "</mark>")
+	return template.HTML(escaped)
+}
+
+// invalidSearch reports sqlite's complaint about a query as a
+// validation error
+func invalidSearch(err error) error {
+	return &siteError{
+		Kind: errValidation,
+		Msg:  "couldn't understand that search",
+		Err:  fmt.Errorf("%w: %s", errInvalidSearch, err),
+	}
+}
+
+// isSearchSyntaxError spots sqlite rejecting the MATCH expression,
+// which is the user's fault rather than ours
+func isSearchSyntaxError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "fts5: syntax error") || strings.Contains(msg, "unterminated string")
+}
+
+// ftsTerm quotes a search term that FTS5 wouldn't take as a bare
+// word, like don't or e-mail, so it's searched as a phrase. FTS5
+// only allows letters, digits and _ in those, where FTS4 just
+// tokenized whatever it was given. parentheses around the term and
+// a prefix * are left outside the quotes.
+func ftsTerm(tok string) string {
+	if strings.HasPrefix(tok, `"`) {
+		return tok
+	}
+	core := strings.TrimLeft(tok, "(")
+	open := tok[:len(tok)-len(core)]
+	trimmed := strings.TrimRight(core, ")")
+	closing := core[len(trimmed):]
+	core = trimmed
+	star := ""
+	if strings.HasSuffix(core, "*") {
+		core, star = strings.TrimSuffix(core, "*"), "*"
+	}
+	if core == "" {
+		return tok
+	}
+	for _, r := range core {
+		if !isBarewordRune(r) {
+			return open + `"` + strings.ReplaceAll(core, `"`, `""`) + `"` + star + closing
+		}
+	}
+	return tok
+}
+
+func isBarewordRune(r rune) bool {
+	return r >= 0x80 || r == '_' || r == 0x1a ||
+		('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+}
+
+// layout for the before: and after: operators
+const searchDateLayout = "2006-01-02"
+
+// searchQuery is a search box query split into the full text
+// part and the filters that become plain SQL predicates
+type searchQuery struct {
+	// passed to MATCH. may be empty if only filters were given
+	Text string
+	// username, from from:
+	From string
+	// channel slug, from in:
+	In string
+	// posted before the start of this day
+	Before time.Time
+	// posted after the end of this day
+	After time.Time
+	// has:link
+	HasLink bool
+}
+
+func (q searchQuery) Empty() bool {
+	return q.Text == "" && !q.HasFilters()
+}
+
+func (q searchQuery) HasFilters() bool {
+	return q.From != "" || q.In != "" || !q.Before.IsZero() || !q.After.IsZero() || q.HasLink
+}
+
+// parseSearchQuery pulls operators like from:alice, in:tech,
+// before:2026-01-01, after:2025-06-30 and has:link out of a query.
+// anything else, including operators inside quotes, is left as
+// full text.
+func parseSearchQuery(raw string) (searchQuery, error) {
+	var q searchQuery
+	var text []string
+	for _, tok := range splitSearchTerms(raw) {
+		op, val, found := strings.Cut(tok, ":")
+		if !found || val == "" || strings.HasPrefix(tok, `"`) {
+			text = append(text, ftsTerm(tok))
+			continue
+		}
+		switch strings.ToLower(op) {
+		case "from":
+			q.From = val
+		case "in":
+			q.In = slugify(val)
+		case "before", "after":
+			d, err := time.Parse(searchDateLayout, val)
+			if err != nil {
+				return q, fmt.Errorf("%w: %s: dates look like 2026-01-31", errInvalidSearch, tok)
+			}
+			if strings.ToLower(op) == "before" {
+				q.Before = d
+			} else {
+				q.After = d
+			}
+		case "has":
+			if strings.ToLower(val) != "link" {
+				return q, fmt.Errorf("%w: %s: only has:link is supported", errInvalidSearch, tok)
+			}
+			q.HasLink = true
+		default:
+			text = append(text, ftsTerm(tok))
+		}
+	}
+	q.Text = strings.Join(text, " ")
+	return q, nil
+}
+
+// splitSearchTerms splits on whitespace, keeping "quoted phrases"
+// together
+func splitSearchTerms(raw string) []string {
+	var terms []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuotes:
+			if current.Len() > 0 {
+				terms = append(terms, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		terms = append(terms, current.String())
+	}
+	return terms
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSnippet(t *testing.T) {
+	got := renderSnippet("a <b> " + snippetStart + "match" + snippetEnd + " & more")
+	want := "a &lt;b&gt; <mark>match</mark> &amp; more"
+	if string(got) != want {
+		t.Errorf("renderSnippet expected %q, got %q", want, got)
+	}
+}
+
+func TestPersistenceSearch(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	u, _ := p.CreateUser(context.Background(), "searcher", "password")
+	bodies := []string{
+		"Un café à Paris",
+		"the quick brown fox",
+		"a fox, a fox, another fox and the quick dog",
+		"quick thinking in the brown study",
+	}
+	posts := make(map[string]*post)
+	for _, b := range bodies {
+		post, err := p.AddPost(context.Background(), *u, b, nil)
+		if err != nil {
+			t.Fatalf("AddPost failed: %v", err)
+		}
+		posts[b] = post
+	}
+
+	tests := []struct {
+		q    string
+		want int
+	}{
+		{"cafe", 1},           // diacritics and case are folded
+		{"FOX", 2},            // case insensitive
+		{`"brown fox"`, 1},    // phrase
+		{"thin*", 1},          // prefix
+		{"quick AND dog", 1},  // boolean
+		{"quick NOT fox", 1},  // negation
+		{"(paris OR dog)", 2}, // grouping
+		{"zebra", 0},
+	}
+	for _, tt := range tests {
+		results, err := p.SearchPosts(context.Background(), searchQuery{Text: tt.q}, 10, 0)
+		if err != nil {
+			t.Errorf("%q: SearchPosts failed: %v", tt.q, err)
+			continue
+		}
+		if len(results) != tt.want {
+			t.Errorf("%q: expected %d results, got %d", tt.q, tt.want, len(results))
+		}
+	}
+
+	// the post that's mostly about foxes ranks first
+	results, _ := p.SearchPosts(context.Background(), searchQuery{Text: "fox"}, 10, 0)
+	if len(results) != 2 || results[0].ID != posts[bodies[2]].ID {
+		t.Errorf("expected the most relevant post first, got %+v", results)
+	}
+	if !strings.Contains(string(results[0].RenderSnippet()), "<mark>fox</mark>") {
+		t.Errorf("expected a highlighted snippet, got %q", results[0].RenderSnippet())
+	}
+
+	// pagination
+	page2, _ := p.SearchPosts(context.Background(), searchQuery{Text: "fox"}, 1, 1)
+	if len(page2) != 1 || page2[0].ID != results[1].ID {
+		t.Errorf("expected the second result on page two, got %+v", page2)
+	}
+
+	// the index follows edits and deletes
+	p.UpdatePost(context.Background(), posts[bodies[0]], "Un thé à Londres", nil)
+	if results, _ := p.SearchPosts(context.Background(), searchQuery{Text: "cafe"}, 10, 0); len(results) != 0 {
+		t.Errorf("expected edited post to drop out of the index")
+	}
+	p.DeletePost(context.Background(), posts[bodies[1]])
+	if results, _ := p.SearchPosts(context.Background(), searchQuery{Text: `"brown fox"`}, 10, 0); len(results) != 0 {
+		t.Errorf("expected deleted post to drop out of the index")
+	}
+
+	_, err := p.SearchPosts(context.Background(), searchQuery{Text: "fox OR"}, 10, 0)
+	if !errors.Is(err, errInvalidSearch) {
+		t.Errorf("expected errInvalidSearch, got %v", err)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	u, _ := s.CreateUser(context.Background(), "searcher", "password")
+	s.AddPost(context.Background(), *u, "searching <script>alert(1)</script> high and low", nil)
+
+	rr := apiRequest(handler, "GET", "/search/?q=searching", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "<mark>searching</mark>") {
+		t.Error("expected the match to be highlighted")
+	}
+	if strings.Contains(body, "<script>alert") {
+		t.Error("snippets must be escaped")
+	}
+
+	rr = apiRequest(handler, "GET", "/search/?q=fox+OR", "", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed query, got %d", rr.Code)
+	}
+
+	// punctuation FTS5 won't take in a bare word is searched as a
+	// phrase rather than being an error
+	s.AddPost(context.Background(), *u, "don't e-mail me", nil)
+	rr = apiRequest(handler, "GET", "/search/?q="+url.QueryEscape("don't e-mail"), "", nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<mark>e-mail</mark>") {
+		t.Errorf("expected punctuated words to match, got %d %q", rr.Code, rr.Body.String())
+	}
+	rr = apiRequest(handler, "GET", "/search/?q="+url.QueryEscape(`"unbalanced`), "", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unbalanced quote, got %d", rr.Code)
+	}
+
+	// a body can't plant its own highlighting, when posted or edited
+	planted, _ := s.AddPost(context.Background(), *u, "planted \x02fake\x03 marks", nil)
+	for _, body := range []string{"", "planted again \x02fake\x03 marks"} {
+		if body != "" {
+			s.UpdatePost(context.Background(), planted, body, nil)
+		}
+		rr = apiRequest(handler, "GET", "/search/?q=planted", "", nil)
+		if n := strings.Count(rr.Body.String(), "<mark>"); rr.Code != http.StatusOK || n != 1 {
+			t.Errorf("expected only the real match highlighted, got %d with %d marks", rr.Code, n)
+		}
+	}
+}
+
+func TestFTSTerm(t *testing.T) {
+	for in, want := range map[string]string{
+		"fox":         "fox",
+		"thin*":       "thin*",
+		"café":        "café",
+		"don't":       `"don't"`,
+		"e-mail*":     `"e-mail"*`,
+		"(co-op":      `("co-op"`,
+		"co-op)":      `"co-op")`,
+		"http://x.io": `"http://x.io"`,
+		`"a phrase"`:  `"a phrase"`,
+		"(":           "(",
+	} {
+		if got := ftsTerm(in); got != want {
+			t.Errorf("ftsTerm(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := parseSearchQuery(`from:alice in:Tech "from:quoted" go* before:2026-01-01 after:2025-06-30 has:link`)
+	if err != nil {
+		t.Fatalf("parseSearchQuery failed: %v", err)
+	}
+	if q.From != "alice" || q.In != "tech" || !q.HasLink {
+		t.Errorf("unexpected filters %+v", q)
+	}
+	if q.Text != `"from:quoted" go*` {
+		t.Errorf("expected the rest left as text, got %q", q.Text)
+	}
+	if q.Before.Format(searchDateLayout) != "2026-01-01" || q.After.Format(searchDateLayout) != "2025-06-30" {
+		t.Errorf("unexpected dates %v %v", q.Before, q.After)
+	}
+
+	for _, bad := range []string{"before:yesterday", "after:2026-13-01", "has:pictures"} {
+		if _, err := parseSearchQuery(bad); !errors.Is(err, errInvalidSearch) {
+			t.Errorf("%q: expected errInvalidSearch, got %v", bad, err)
+		}
+	}
+
+	if q, _ := parseSearchQuery("   "); !q.Empty() {
+		t.Errorf("expected an empty query, got %+v", q)
+	}
+}
+
+func TestPersistenceSearchFilters(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	alice, _ := p.CreateUser(context.Background(), "alice", "password")
+	bob, _ := p.CreateUser(context.Background(), "bob", "password")
+	aliceTech, _ := p.AddChannels(context.Background(), *alice, []string{"Tech"})
+	bobTech, _ := p.AddChannels(context.Background(), *bob, []string{"Tech"})
+
+	day := func(s string) int {
+		d, _ := time.Parse(searchDateLayout, s)
+		return int(d.Unix()) + 3600
+	}
+	add := func(u *user, body string, channels []*channel, posted int) {
+		post, err := p.AddPost(context.Background(), *u, body, channels)
+		if err != nil {
+			t.Fatalf("AddPost failed: %v", err)
+		}
+		p.Database.Exec(`update post set posted = ? where id = ?`, posted, post.ID)
+	}
+	add(alice, "golang tips", aliceTech, day("2025-12-01"))
+	add(alice, "golang at https://go.dev", aliceTech, day("2026-02-01"))
+	add(alice, "golang and cooking", nil, day("2026-02-02"))
+	add(bob, "golang for bob", bobTech, day("2026-02-03"))
+
+	tests := []struct {
+		q    string
+		want int
+	}{
+		{"golang", 4},
+		{"golang from:alice", 3},
+		{"from:alice", 3}, // filters alone work too
+		{"golang from:alice in:tech", 2},
+		{"in:tech", 3},
+		{"from:alice in:tech before:2026-01-01", 1},
+		{"from:alice after:2026-02-01", 1},
+		{"from:alice after:2026-01-31 before:2026-02-02", 1},
+		{"has:link", 1},
+		{"from:nobody", 0},
+	}
+	for _, tt := range tests {
+		q, err := parseSearchQuery(tt.q)
+		if err != nil {
+			t.Fatalf("%q: parseSearchQuery failed: %v", tt.q, err)
+		}
+		results, err := p.SearchPosts(context.Background(), q, 10, 0)
+		if err != nil {
+			t.Errorf("%q: SearchPosts failed: %v", tt.q, err)
+			continue
+		}
+		if len(results) != tt.want {
+			t.Errorf("%q: expected %d results, got %d", tt.q, tt.want, len(results))
+		}
+	}
+}
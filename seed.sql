@@ -3,6 +3,7 @@ DELETE FROM users;
 DELETE FROM channel;
 DELETE FROM post;
 DELETE FROM postchannel;
+DELETE FROM post_fts;
 
 -- Insert test user (username: testuser, password: password)
 INSERT INTO users (id, username, password) VALUES (1, 'testuser', '$2a$10$0ehrzCMCLhcmjEyU1egoKev1/cg/8OtqBRDR9Cf9aFEgyb96Bx1le');
@@ -27,3 +28,6 @@ INSERT INTO postchannel (post_id, channel_id) VALUES (2, 2);
 INSERT INTO postchannel (post_id, channel_id) VALUES (3, 3);
 INSERT INTO postchannel (post_id, channel_id) VALUES (4, 1);
 INSERT INTO postchannel (post_id, channel_id) VALUES (4, 2);
+
+-- Index the posts for search
+INSERT INTO post_fts (rowid, body) SELECT id, body FROM post;
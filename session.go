@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	sessionMaxAge = 30 * 24 * time.Hour
+	// last seen is only written this often, so most requests
+	// don't have to wait on the writer
+	sessionTouchEvery      = 5 * time.Minute
+	sessionCleanupInterval = time.Hour
+	maxUserAgent           = 256
+)
+
+type userSession struct {
+	IDHash    string
+	Username  string
+	Data      []byte
+	UserAgent string
+	IP        string
+	Created   int
+	LastSeen  int
+	Expires   int
+	// set when listing, for the one the request came in on
+	Current bool
+}
+
+// sessionCookie is what goes in the cookie: the id of a logged in
+// session, or the values of an anonymous one
+type sessionCookie struct {
+	ID     string
+	Values map[interface{}]interface{}
+}
+
+func (us userSession) CreatedTime() time.Time {
+	return time.Unix(int64(us.Created), 0)
+}
+
+func (us userSession) LastSeenTime() time.Time {
+	return time.Unix(int64(us.LastSeen), 0)
+}
+
+// sessionStore is a sessions.Store that keeps logged in sessions in
+// the database and only a signed id in the cookie. unlike the cookie
+// store, they can be listed and revoked, and knowing the secret
+// isn't enough to make one up. anonymous sessions only hold a CSRF
+// token or a login waiting on a two factor code, so they stay in
+// the signed cookie and never touch the database; see
+// anonymousKeys.
+type sessionStore struct {
+	s       *site
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	// this version of sessions.Options doesn't have it
+	SameSite http.SameSite
+}
+
+// newSessionStore takes key pairs like sessions.NewCookieStore: a
+// hash key and an optional encryption key. new cookies use the
+// first pair; the rest are only for reading old ones.
+func newSessionStore(s *site, keyPairs ...[]byte) *sessionStore {
+	st := &sessionStore{
+		s:      s,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(sessionMaxAge.Seconds()),
+			HttpOnly: true,
+			// https only if the site is
+			Secure: strings.HasPrefix(s.BaseURL, "https://"),
+		},
+		SameSite: http.SameSiteLaxMode,
+	}
+	for _, codec := range st.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(st.Options.MaxAge)
+		}
+	}
+	return st
+}
+
+// Get returns the session cached for the request, loading it the
+// first time
+func (st *sessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(st, name)
+}
+
+// New loads the session named in the cookie. a missing, expired or
+// revoked one just starts a new session.
+func (st *sessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(st, name)
+	opts := *st.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var sc sessionCookie
+	if err := securecookie.DecodeMulti(name, c.Value, &sc, st.Codecs...); err != nil {
+		return session, err
+	}
+	if sc.ID == "" {
+		session.Values = anonymousValues(sc.Values)
+		session.IsNew = false
+		return session, nil
+	}
+	id := sc.ID
+	us, err := st.s.GetSession(r.Context(), hashToken(id))
+	if errors.Is(err, errNotFound) {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(us.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+
+	now := st.s.now()
+	if now.Sub(us.LastSeenTime()) >= sessionTouchEvery {
+		us.LastSeen = int(now.Unix())
+		us.UserAgent, us.IP = userAgent(r), st.s.clientIP(r)
+		if err := st.s.TouchSession(r.Context(), *us); err != nil {
+			log.Printf("touching session: %v", err)
+		}
+	}
+	return session, nil
+}
+
+// Save writes the session and sets the cookie. a MaxAge of zero or
+// less deletes it.
+func (st *sessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := st.s.DeleteSession(r.Context(), hashToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, st.cookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	username, _ := session.Values["user"].(string)
+	if username == "" {
+		return st.saveAnonymous(r, w, session)
+	}
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+	now := st.s.now()
+	us := userSession{
+		IDHash:    hashToken(session.ID),
+		Username:  username,
+		Data:      data.Bytes(),
+		UserAgent: userAgent(r),
+		IP:        st.s.clientIP(r),
+		Created:   int(now.Unix()),
+		LastSeen:  int(now.Unix()),
+		Expires:   int(now.Unix()) + session.Options.MaxAge,
+	}
+	if err := st.s.SaveSession(r.Context(), us); err != nil {
+		return err
+	}
+
+	return st.setCookie(w, session, sessionCookie{ID: session.ID})
+}
+
+// saveAnonymous puts a session with nobody logged in into the
+// cookie. if it used to be logged in, its row goes.
+func (st *sessionStore) saveAnonymous(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.ID != "" {
+		if err := st.s.DeleteSession(r.Context(), hashToken(session.ID)); err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+	return st.setCookie(w, session, sessionCookie{Values: anonymousValues(session.Values)})
+}
+
+// anonymousKeys are the only values a session kept in the cookie
+// can carry. being logged in has to come from a row in the
+// database, so a cookie signed with a leaked secret still can't
+// claim to be someone.
+var anonymousKeys = []string{csrfSession, pendingUser, pendingAt}
+
+func anonymousValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	kept := make(map[interface{}]interface{})
+	for _, k := range anonymousKeys {
+		if v, ok := values[k]; ok {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+func (st *sessionStore) setCookie(w http.ResponseWriter, session *sessions.Session, sc sessionCookie) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), sc, st.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, st.cookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (st *sessionStore) cookie(name, value string, opts *sessions.Options) *http.Cookie {
+	c := sessions.NewCookie(name, value, opts)
+	c.SameSite = st.SameSite
+	return c
+}
+
+// sessionKeys reads the cookie keys from the environment:
+//
+//	FINCH_SECRET          signs cookies. required.
+//	FINCH_ENCRYPTION_KEY  also encrypts them if set. hex encoded,
+//	                      16, 24 or 32 bytes.
+//	FINCH_OLD_SECRETS     comma separated secret[:encryption key]
+//	                      pairs that were in use before, so cookies
+//	                      made with them keep working while the
+//	                      keys are rotated
+func sessionKeys(getenv func(string) string) ([][]byte, error) {
+	secret := getenv("FINCH_SECRET")
+	if secret == "" {
+		return nil, errors.New("FINCH_SECRET must be set")
+	}
+	enc, err := encryptionKey(getenv("FINCH_ENCRYPTION_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("FINCH_ENCRYPTION_KEY: %w", err)
+	}
+	keys := [][]byte{[]byte(secret), enc}
+	for _, pair := range strings.Split(getenv("FINCH_OLD_SECRETS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		old, oldEnc, _ := strings.Cut(pair, ":")
+		if old == "" {
+			return nil, errors.New("FINCH_OLD_SECRETS: empty secret")
+		}
+		enc, err := encryptionKey(oldEnc)
+		if err != nil {
+			return nil, fmt.Errorf("FINCH_OLD_SECRETS: %w", err)
+		}
+		keys = append(keys, []byte(old), enc)
+	}
+	return keys, nil
+}
+
+// encryptionKey decodes a hex AES key. no key is fine and means
+// cookies are signed but not encrypted.
+func encryptionKey(h string) ([]byte, error) {
+	if h == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, errors.New("encryption key must be hex encoded")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes, not %d", len(key))
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgent {
+		ua = ua[:maxUserAgent]
+	}
+	return ua
+}
+
+// renewSession gives the session a new id when it's next saved and
+// deletes the old one, so an id someone knew before a login can't
+// be used after it. the values carry over.
+func renewSession(s *site, r *http.Request, sess *sessions.Session) error {
+	if sess.ID != "" {
+		if err := s.DeleteSession(r.Context(), hashToken(sess.ID)); err != nil {
+			return err
+		}
+	}
+	sess.ID = ""
+	sess.IsNew = true
+	return nil
+}
+
+// logIn makes the request's session a logged in one for username,
+// under a new id and with a new CSRF token
+func logIn(s *site, w http.ResponseWriter, r *http.Request, username string) error {
+	sess, _ := s.Store.Get(r, "finch")
+	if err := renewSession(s, r, sess); err != nil {
+		return err
+	}
+	delete(sess.Values, pendingUser)
+	delete(sess.Values, pendingAt)
+	sess.Values["user"] = username
+	sess.Values[csrfSession] = newCSRFToken()
+	return sess.Save(r, w)
+}
+
+// awaitSecondFactor is logIn for someone who still has to enter a
+// two factor code. whoever was logged in before isn't any more.
+func awaitSecondFactor(s *site, w http.ResponseWriter, r *http.Request, username string) error {
+	sess, _ := s.Store.Get(r, "finch")
+	if err := renewSession(s, r, sess); err != nil {
+		return err
+	}
+	delete(sess.Values, "user")
+	sess.Values[pendingUser] = username
+	sess.Values[pendingAt] = s.now().Unix()
+	sess.Values[csrfSession] = newCSRFToken()
+	return sess.Save(r, w)
+}
+
+// currentSession is the id hash of the session a request came in
+// on, or "" if it doesn't have one yet
+func currentSession(s *site, r *http.Request) string {
+	sess, _ := s.Store.Get(r, "finch")
+	if sess == nil || sess.ID == "" {
+		return ""
+	}
+	return hashToken(sess.ID)
+}
+
+// cleanSessions clears out expired sessions every so often until
+// ctx is done
+func cleanSessions(ctx context.Context, s *site, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if n, err := s.DeleteExpiredSessions(ctx); err != nil {
+				log.Printf("cleaning up sessions: %v", err)
+			} else if n > 0 {
+				log.Printf("cleaned up %d expired sessions", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestLogoutOtherSessions(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "roaming", "password")
+	laptop := loginCookies(t, handler, "roaming", "password")
+	phone := loginCookies(t, handler, "roaming", "password")
+
+	rr := apiRequest(handler, "GET", "/settings/", "", laptop)
+	if n := strings.Count(rr.Body.String(), "last seen"); n != 2 {
+		t.Errorf("expected both sessions listed, found %d", n)
+	}
+	if n := strings.Count(rr.Body.String(), "this session"); n != 1 {
+		t.Errorf("expected one session marked as the current one, found %d", n)
+	}
+
+	resp := formRequest(handler, "/settings/sessions/logout/", url.Values{}, laptop)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the settings page back, got %d", resp.StatusCode)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", phone); rr.Code != http.StatusFound {
+		t.Errorf("expected the other session to be logged out, got %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", laptop); rr.Code != http.StatusOK {
+		t.Errorf("expected the current session to stay logged in, got %d", rr.Code)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "leaving", "password")
+	cookies := loginCookies(t, handler, "leaving", "password")
+
+	formRequest(handler, "/logout/", url.Values{}, cookies)
+	// a copy of the cookie taken before logging out is no good
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusFound {
+		t.Errorf("expected the old cookie to be revoked, got %d", rr.Code)
+	}
+	u, _ := s.GetUser(context.Background(), "leaving")
+	if sessions, _ := s.GetUserSessions(context.Background(), *u); len(sessions) != 0 {
+		t.Errorf("expected the session to be deleted, found %d", len(sessions))
+	}
+}
+
+func TestSessionCookieSigned(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "victim", "password")
+	cookies := loginCookies(t, handler, "victim", "password")
+	store := s.Store.(*sessionStore)
+
+	// the right session id signed with some other secret
+	other := newSessionStore(s, []byte("not the secret"))
+	for _, c := range cookies {
+		var sc sessionCookie
+		if err := securecookie.DecodeMulti(c.Name, c.Value, &sc, store.Codecs...); err != nil {
+			t.Fatalf("decoding the cookie failed: %v", err)
+		}
+		if sc.ID == "" {
+			t.Fatal("expected a logged in session to be kept by id")
+		}
+		c.Value, _ = securecookie.EncodeMulti(c.Name, sc, other.Codecs...)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusFound {
+		t.Errorf("expected a cookie signed with the wrong secret to be ignored, got %d", rr.Code)
+	}
+
+	// anonymous sessions are kept in the cookie, so one made up
+	// with someone logged in has to be signed too
+	forged := sessionCookie{Values: map[interface{}]interface{}{"user": "victim"}}
+	value, _ := securecookie.EncodeMulti("finch", forged, other.Codecs...)
+	forgedCookies := []*http.Cookie{{Name: "finch", Value: value}}
+	if rr := apiRequest(handler, "GET", "/settings/", "", forgedCookies); rr.Code != http.StatusFound {
+		t.Errorf("expected a forged anonymous cookie to be ignored, got %d", rr.Code)
+	}
+}
+
+func TestAnonymousCookieCantLogIn(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "victim", "password")
+	store := s.Store.(*sessionStore)
+
+	// even signed with the real secret, a cookie only ever carries
+	// an anonymous session
+	forged := sessionCookie{Values: map[interface{}]interface{}{"user": "victim"}}
+	value, err := securecookie.EncodeMulti("finch", forged, store.Codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := []*http.Cookie{{Name: "finch", Value: value}}
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusFound {
+		t.Errorf("expected a signed anonymous cookie not to log anyone in, got %d", rr.Code)
+	}
+
+	// and one isn't written with a user in it either
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "finch")
+	sess.Values["user"] = "victim"
+	sess.Values[csrfSession] = "token"
+	rr := httptest.NewRecorder()
+	if err := store.saveAnonymous(req, rr, sess); err != nil {
+		t.Fatal(err)
+	}
+	var sc sessionCookie
+	c := rr.Result().Cookies()[0]
+	if err := securecookie.DecodeMulti(c.Name, c.Value, &sc, store.Codecs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sc.Values["user"]; ok || sc.Values[csrfSession] != "token" {
+		t.Errorf("expected only the anonymous values in the cookie, got %v", sc.Values)
+	}
+}
+
+func TestAnonymousSessionsStayOutOfTheDatabase(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "visitor", "password")
+
+	for _, path := range []string{"/healthz/", "/media/css/style.css", "/", "/login/"} {
+		for i := 0; i < 5; i++ {
+			apiRequest(handler, "GET", path, "", nil)
+		}
+	}
+	if n := countRows(t, s.p, "session"); n != 0 {
+		t.Errorf("expected no session rows for anonymous visitors, found %d", n)
+	}
+
+	// nothing that doesn't need one gets a cookie at all
+	for _, path := range []string{"/healthz/", "/media/css/style.css"} {
+		if rr := apiRequest(handler, "GET", path, "", nil); len(rr.Result().Cookies()) != 0 {
+			t.Errorf("GET %s: expected no session cookie", path)
+		}
+	}
+	u, _ := s.GetUser(context.Background(), "visitor")
+	_, secret, _ := s.CreateToken(context.Background(), *u, "bot")
+	req := newAPIRequest("GET", "/api/v1/posts/", "")
+	req.Header.Set("Authorization", "Bearer "+secret)
+	if rr := serve(handler, req); rr.Code != http.StatusOK || len(rr.Result().Cookies()) != 0 {
+		t.Errorf("expected a token request to get no cookie, got %d %v", rr.Code, rr.Result().Cookies())
+	}
+
+	// the anonymous cookie still carries the CSRF token through a
+	// login, and the login is what makes a row
+	loginCookies(t, handler, "visitor", "password")
+	if n := countRows(t, s.p, "session"); n != 1 {
+		t.Errorf("expected one row once logged in, found %d", n)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	clock := &fakeClock{t: time.Now()}
+	s.now = clock.Now
+	s.CreateUser(context.Background(), "sleepy", "password")
+	cookies := loginCookies(t, handler, "sleepy", "password")
+
+	clock.Advance(sessionTouchEvery + time.Minute)
+	apiRequest(handler, "GET", "/settings/", "", cookies)
+	u, _ := s.GetUser(context.Background(), "sleepy")
+	sessions, _ := s.GetUserSessions(context.Background(), *u)
+	if len(sessions) != 1 || !sessions[0].LastSeenTime().Equal(clock.Now().Truncate(time.Second)) {
+		t.Errorf("expected last seen to be updated, got %v", sessions)
+	}
+
+	clock.Advance(sessionMaxAge)
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusFound {
+		t.Errorf("expected an expired session to be logged out, got %d", rr.Code)
+	}
+	n, err := s.DeleteExpiredSessions(context.Background())
+	if err != nil || n != 1 {
+		t.Errorf("expected the expired session to be cleaned up, got %d %v", n, err)
+	}
+	// the anonymous session that request started has no row
+	if n := countRows(t, s.p, "session"); n != 0 {
+		t.Errorf("expected no sessions left, found %d", n)
+	}
+}
+
+func TestSessionKeys(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(k string) string { return vars[k] }
+	}
+	for _, vars := range []map[string]string{
+		{},
+		{"FINCH_SECRET": "s", "FINCH_ENCRYPTION_KEY": "not hex"},
+		{"FINCH_SECRET": "s", "FINCH_ENCRYPTION_KEY": "abcd"},
+		{"FINCH_SECRET": "s", "FINCH_OLD_SECRETS": ":" + strings.Repeat("ab", 16)},
+	} {
+		if _, err := sessionKeys(env(vars)); err == nil {
+			t.Errorf("expected %v to be refused", vars)
+		}
+	}
+
+	keys, err := sessionKeys(env(map[string]string{
+		"FINCH_SECRET":         "new",
+		"FINCH_ENCRYPTION_KEY": strings.Repeat("ab", 32),
+		"FINCH_OLD_SECRETS":    "older, old:" + strings.Repeat("cd", 16),
+	}))
+	if err != nil {
+		t.Fatalf("sessionKeys failed: %v", err)
+	}
+	if len(keys) != 6 || string(keys[0]) != "new" || len(keys[1]) != 32 ||
+		string(keys[2]) != "older" || keys[3] != nil || string(keys[4]) != "old" || len(keys[5]) != 16 {
+		t.Errorf("unexpected keys %q", keys)
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "rotating", "password")
+	cookies := loginCookies(t, handler, "rotating", "password")
+
+	// the secret changes, with the old one kept for reading
+	enc := strings.Repeat("ab", 32)
+	keys, _ := sessionKeys(func(k string) string {
+		return map[string]string{"FINCH_SECRET": "fresh", "FINCH_ENCRYPTION_KEY": enc, "FINCH_OLD_SECRETS": "secret"}[k]
+	})
+	s.Store = newSessionStore(s, keys...)
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusOK {
+		t.Fatalf("expected a cookie from the old secret to still work, got %d", rr.Code)
+	}
+
+	// new cookies only use the new keys
+	fresh := loginCookies(t, handler, "rotating", "password")
+	s.Store = newSessionStore(s, []byte("fresh"), mustHex(t, enc))
+	if rr := apiRequest(handler, "GET", "/settings/", "", fresh); rr.Code != http.StatusOK {
+		t.Errorf("expected the new cookie to work without the old secret, got %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", cookies); rr.Code != http.StatusFound {
+		t.Errorf("expected the old cookie to stop working once its secret is dropped, got %d", rr.Code)
+	}
+}
+
+func mustHex(t *testing.T, h string) []byte {
+	t.Helper()
+	b, err := encryptionKey(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSessionCookieOptions(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "careful", "password")
+
+	cookies := loginCookies(t, handler, "careful", "password")
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].Secure || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("unexpected cookie over http: %+v", cookies)
+	}
+
+	s.BaseURL = "https://finch.example.com"
+	s.Store = newSessionStore(s, []byte("secret"))
+	cookies = loginCookies(t, handler, "careful", "password")
+	if len(cookies) != 1 || !cookies[0].Secure {
+		t.Errorf("expected a secure cookie for an https site: %+v", cookies)
+	}
+}
+
+func TestLoginRenewsSession(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "fixated", "password")
+	s.CreateUser(context.Background(), "other", "password")
+
+	// a cookie handed out before logging in, as an attacker
+	// planting one would have
+	_, before := csrfFor(handler, nil)
+	token, cookies := csrfFor(handler, before)
+	form := url.Values{"username": {"fixated"}, "password": {"password"}, csrfField: {token}}
+	req := newAPIRequest("POST", "/login/", form.Encode())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := serve(handler, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("login failed: %d", rr.Code)
+	}
+	after := rr.Result().Cookies()
+	if len(after) == 0 || after[0].Value == before[0].Value {
+		t.Fatal("expected a new session cookie at login")
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", before); rr.Code != http.StatusFound {
+		t.Errorf("expected the cookie from before login not to be logged in, got %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", after); rr.Code != http.StatusOK {
+		t.Errorf("expected the new cookie to be logged in, got %d", rr.Code)
+	}
+
+	// logging in as someone else over the top does the same
+	token, _ = csrfFor(handler, after)
+	form = url.Values{"username": {"other"}, "password": {"password"}, csrfField: {token}}
+	req = newAPIRequest("POST", "/login/", form.Encode())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range after {
+		req.AddCookie(c)
+	}
+	if rr := serve(handler, req); rr.Code != http.StatusFound {
+		t.Fatalf("second login failed: %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", after); rr.Code != http.StatusFound {
+		t.Errorf("expected the first user's session to be gone, got %d", rr.Code)
+	}
+	u, _ := s.GetUser(context.Background(), "fixated")
+	if sessions, _ := s.GetUserSessions(context.Background(), *u); len(sessions) != 0 {
+		t.Errorf("expected the replaced session's row to be deleted, found %d", len(sessions))
+	}
+}
+
+func TestPasswordChangeRevokesCredentials(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	u, _ := s.CreateUser(context.Background(), "compromised", "old password 1")
+	laptop := loginCookies(t, handler, "compromised", "old password 1")
+	phone := loginCookies(t, handler, "compromised", "old password 1")
+	_, secret, _ := s.CreateToken(context.Background(), *u, "script")
+
+	form := url.Values{"current": {"old password 1"}, "password": {"new pass 42"}, "confirm": {"new pass 42"}}
+	if resp := formRequest(handler, "/settings/password/", form, laptop); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", laptop); rr.Code != http.StatusOK {
+		t.Errorf("expected the session that changed it to stay logged in, got %d", rr.Code)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", phone); rr.Code != http.StatusFound {
+		t.Errorf("expected other sessions to be logged out, got %d", rr.Code)
+	}
+	if _, err := s.UseToken(context.Background(), secret); err == nil {
+		t.Error("expected API tokens to be revoked")
+	}
+
+	// a reset link cuts off everything
+	_, secret, _ = s.CreateToken(context.Background(), *u, "script")
+	link, err := s.CreateResetLink(context.Background(), *u)
+	if err != nil {
+		t.Fatalf("CreateResetLink failed: %v", err)
+	}
+	resetPath := strings.TrimPrefix(link, s.BaseURL)
+	form = url.Values{"password": {"newer pass 43"}, "confirm": {"newer pass 43"}}
+	if resp := formRequest(handler, resetPath, form, nil); resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the reset to log in and redirect, got %d", resp.StatusCode)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", laptop); rr.Code != http.StatusFound {
+		t.Errorf("expected a reset to log out every session, got %d", rr.Code)
+	}
+	if _, err := s.UseToken(context.Background(), secret); err == nil {
+		t.Error("expected a reset to revoke API tokens")
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+type settingsResponse struct {
+	Profile *user
+	Tokens  []*apiToken
+	// only set right after a token is created. it's the one
+	// chance the user gets to copy the secret.
+	NewToken  *apiToken
+	NewSecret string
+	// recent failed logins against the account
+	LoginAttempts []*loginAttempt
+	// outcome of a password or profile change
+	Message string
+	Error   string
+	Errors  map[string]string
+	// only set right after two factor auth is turned on
+	RecoveryCodes     []string
+	RecoveryCodesLeft int
+	// invites are only shown when registration is invite only.
+	// like tokens, a new invite's link is only shown once.
+	InviteMode    bool
+	Invites       []*invite
+	NewInvite     *invite
+	NewInviteLink string
+	Invitees      []string
+	// everywhere the user is logged in
+	Sessions []*userSession
+	siteResponse
+}
+
+// load fills in the parts of the page that come from the database
+func (sr *settingsResponse) load(r *http.Request, s *site, u user) error {
+	sr.Profile = &u
+	tokens, err := s.GetUserTokens(r.Context(), u)
+	if err != nil {
+		return err
+	}
+	sr.Tokens = tokens
+	attempts, err := s.GetLoginAttempts(r.Context(), u.Username, 10)
+	if err != nil {
+		return err
+	}
+	sr.LoginAttempts = attempts
+	if u.TOTPEnabled {
+		n, err := s.CountRecoveryCodes(r.Context(), u)
+		if err != nil {
+			return err
+		}
+		sr.RecoveryCodesLeft = n
+	}
+	sr.InviteMode = s.Registration() == registrationInvite
+	if sr.InviteMode {
+		if sr.Invites, err = s.GetUserInvites(r.Context(), u); err != nil {
+			return err
+		}
+	}
+	// people who came in on an invite stay listed even if the
+	// mode changes
+	if sr.Invitees, err = s.GetInvitees(r.Context(), u); err != nil {
+		return err
+	}
+	if sr.Sessions, err = s.GetUserSessions(r.Context(), u); err != nil {
+		return err
+	}
+	current := currentSession(s, r)
+	for _, us := range sr.Sessions {
+		us.Current = us.IDHash == current
+	}
+	return nil
+}
+
+func settingsHandler(s *site) http.Handler {
+	tmpl := getTemplate("settings.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			sr := settingsResponse{}
+			ctx.PopulateResponse(&sr)
+			if err := sr.load(r, s, *ctx.User); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			render(w, ctx, tmpl, http.StatusOK, sr)
+		})
+}
+
+func createTokenHandler(s *site) http.Handler {
+	tmpl := getTemplate("settings.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			label := r.FormValue("label")
+			if label == "" {
+				label = "untitled"
+			}
+			token, secret, err := s.CreateToken(r.Context(), *ctx.User, label)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			// render directly rather than redirecting so the
+			// secret never has to be stashed in the session
+			sr := settingsResponse{NewToken: token, NewSecret: secret}
+			ctx.PopulateResponse(&sr)
+			if err := sr.load(r, s, *ctx.User); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			render(w, ctx, tmpl, http.StatusOK, sr)
+		})
+}
+
+func tokenLabelHandler(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			id, err := strconv.Atoi(r.PathValue("id"))
+			if err != nil {
+				errorPage(w, ctx, http.StatusNotFound, "token not found")
+				return
+			}
+			label := r.FormValue("label")
+			if label == "" {
+				label = "untitled"
+			}
+			if err := s.UpdateTokenLabel(r.Context(), *ctx.User, id, label); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/", http.StatusFound)
+		})
+}
+
+func tokenDeleteHandler(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			id, err := strconv.Atoi(r.PathValue("id"))
+			if err != nil {
+				errorPage(w, ctx, http.StatusNotFound, "token not found")
+				return
+			}
+			if err := s.DeleteToken(r.Context(), *ctx.User, id); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/", http.StatusFound)
+		})
+}
+
+// accountFormHandler handles the forms on the settings page that
+// show the page again with how it went
+func accountFormHandler(s *site, update func(*http.Request, user, *settingsResponse) error, done string) http.Handler {
+	tmpl := getTemplate("settings.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			sr := settingsResponse{}
+			status := http.StatusOK
+			err := update(r, *ctx.User, &sr)
+			switch {
+			case errors.Is(err, errValidation):
+				// problems with a field are shown next to it
+				if sr.Errors = fieldErrors(err); sr.Errors == nil {
+					sr.Error = errorMessage(err)
+				}
+				status = http.StatusUnprocessableEntity
+			case err != nil:
+				renderError(w, ctx, err)
+				return
+			default:
+				sr.Message = done
+				// pick up the new profile
+				if ctx.User, err = s.GetUser(r.Context(), ctx.User.Username); err != nil {
+					renderError(w, ctx, err)
+					return
+				}
+			}
+			ctx.PopulateResponse(&sr)
+			if err := sr.load(r, s, *ctx.User); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			render(w, ctx, tmpl, status, sr)
+		})
+}
+
+func passwordHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, _ *settingsResponse) error {
+		return s.ChangePassword(r.Context(), u, currentSession(s, r), r.FormValue("current"),
+			r.FormValue("password"), r.FormValue("confirm"))
+	}, "password changed")
+}
+
+func profileHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, _ *settingsResponse) error {
+		return s.UpdateProfile(r.Context(), u, r.FormValue("display_name"), r.FormValue("bio"))
+	}, "profile saved")
+}
+
+func logoutOtherSessionsHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, _ *settingsResponse) error {
+		_, err := s.LogoutOtherSessions(r.Context(), u, currentSession(s, r))
+		return err
+	}, "logged out of your other sessions")
+}
+
+type deleteAccountResponse struct {
+	Errors map[string]string
+	siteResponse
+}
+
+func deleteAccountFormHandler(s *site) http.Handler {
+	tmpl := getTemplate("delete_account.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			dr := deleteAccountResponse{}
+			ctx.PopulateResponse(&dr)
+			render(w, ctx, tmpl, http.StatusOK, dr)
+		})
+}
+
+func deleteAccountHandler(s *site) http.Handler {
+	tmpl := getTemplate("delete_account.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			err := s.DeleteAccount(r.Context(), *ctx.User, r.FormValue("password"), r.FormValue("confirm"))
+			if errors.Is(err, errValidation) {
+				dr := deleteAccountResponse{Errors: fieldErrors(err)}
+				ctx.PopulateResponse(&dr)
+				render(w, ctx, tmpl, http.StatusUnprocessableEntity, dr)
+				return
+			}
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			sess, _ := s.Store.Get(r, "finch")
+			delete(sess.Values, "user")
+			sess.Save(r, w)
+			http.Redirect(w, r, "/", http.StatusFound)
+		})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func formRequest(handler http.Handler, path string, form url.Values, cookies []*http.Cookie) *http.Response {
+	token, cookies := csrfFor(handler, cookies)
+	form.Set(csrfField, token)
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return serve(handler, req).Result()
+}
+
+func TestSettingsTokens(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	u, _ := s.CreateUser(context.Background(), "settingsuser", "password")
+
+	rr := apiRequest(handler, "GET", "/settings/", "", nil)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("anonymous users should be redirected, got %d", rr.Code)
+	}
+
+	cookies := loginCookies(t, handler, "settingsuser", "password")
+	resp := formRequest(handler, "/settings/tokens/", url.Values{"label": {"cli"}}, cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	tokens, _ := s.GetUserTokens(context.Background(), *u)
+	if len(tokens) != 1 || tokens[0].Label != "cli" {
+		t.Fatalf("expected one cli token, got %+v", tokens)
+	}
+
+	id := strconv.Itoa(tokens[0].ID)
+	resp = formRequest(handler, "/settings/tokens/"+id+"/delete/", url.Values{}, cookies)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", resp.StatusCode)
+	}
+	tokens, _ = s.GetUserTokens(context.Background(), *u)
+	if len(tokens) != 0 {
+		t.Errorf("expected token to be revoked, have %d", len(tokens))
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "changer", "oldpass")
+	cookies := loginCookies(t, handler, "changer", "oldpass")
+
+	bad := []url.Values{
+		{"current": {"wrong"}, "password": {"new pass 42"}, "confirm": {"new pass 42"}},
+		{"current": {"oldpass"}, "password": {"new pass 42"}, "confirm": {"typo"}},
+		{"current": {"oldpass"}, "password": {""}, "confirm": {""}},
+	}
+	for _, form := range bad {
+		if resp := formRequest(handler, "/settings/password/", form, cookies); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("%v: expected 422, got %d", form, resp.StatusCode)
+		}
+	}
+	if u, _ := s.GetUser(context.Background(), "changer"); !u.CheckPassword("oldpass") {
+		t.Fatal("a rejected change still changed the password")
+	}
+
+	form := url.Values{"current": {"oldpass"}, "password": {"new pass 42"}, "confirm": {"new pass 42"}}
+	if resp := formRequest(handler, "/settings/password/", form, cookies); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	u, _ := s.GetUser(context.Background(), "changer")
+	if !u.CheckPassword("new pass 42") || u.CheckPassword("oldpass") {
+		t.Error("expected the password to be changed")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "profiled", "password")
+	cookies := loginCookies(t, handler, "profiled", "password")
+
+	form := url.Values{"display_name": {" Pro <b>Filed</b> "}, "bio": {"I post things."}}
+	if resp := formRequest(handler, "/settings/profile/", form, cookies); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	u, _ := s.GetUser(context.Background(), "profiled")
+	if u.DisplayName != "Pro <b>Filed</b>" || u.Bio != "I post things." || u.Name() != u.DisplayName {
+		t.Errorf("profile not saved: %+v", u)
+	}
+
+	body := apiRequest(handler, "GET", "/u/profiled/", "", nil).Body.String()
+	if !strings.Contains(body, "Pro &lt;b&gt;Filed&lt;/b&gt;") || !strings.Contains(body, "I post things.") {
+		t.Error("expected the user page to show the escaped display name and bio")
+	}
+
+	form = url.Values{"display_name": {strings.Repeat("x", maxDisplayName+1)}}
+	if resp := formRequest(handler, "/settings/profile/", form, cookies); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a long display name, got %d", resp.StatusCode)
+	}
+}
+
+func TestResetLink(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	u, _ := s.CreateUser(ctx, "forgetful", "forgotten")
+	// a lockout shouldn't stop the reset from getting them back in
+	s.p.Database.Exec(`update users set locked_until = ? where id = ?`, time.Now().Add(time.Hour).Unix(), u.ID)
+
+	link, err := s.CreateResetLink(ctx, *u)
+	if err != nil {
+		t.Fatalf("CreateResetLink failed: %v", err)
+	}
+	path := strings.TrimPrefix(link, s.BaseURL)
+	if rr := apiRequest(handler, "GET", path, "", nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "forgetful") {
+		t.Fatalf("expected the reset form, got %d", rr.Code)
+	}
+	resp := formRequest(handler, path, url.Values{"password": {"remembered"}, "confirm": {"nope"}}, nil)
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for mismatched passwords, got %d", resp.StatusCode)
+	}
+
+	resp = formRequest(handler, path, url.Values{"password": {"remembered"}, "confirm": {"remembered"}}, nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect after the reset, got %d", resp.StatusCode)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", resp.Cookies()); rr.Code != http.StatusOK {
+		t.Errorf("expected to be logged in after the reset, got %d", rr.Code)
+	}
+	if _, err := s.Login(ctx, "forgetful", "remembered", "10.0.0.1"); err != nil {
+		t.Errorf("expected to log in with the new password, got %v", err)
+	}
+
+	// links are one time only
+	if rr := apiRequest(handler, "GET", path, "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected a used link to 404, got %d", rr.Code)
+	}
+	resp = formRequest(handler, path, url.Values{"password": {"again"}, "confirm": {"again"}}, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a used link to be refused, got %d", resp.StatusCode)
+	}
+
+	link, _ = s.CreateResetLink(ctx, *u)
+	s.p.Database.Exec(`update password_reset set expires = ?`, time.Now().Add(-time.Minute).Unix())
+	if rr := apiRequest(handler, "GET", strings.TrimPrefix(link, s.BaseURL), "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected an expired link to 404, got %d", rr.Code)
+	}
+}
+
+func TestResetLinkCommand(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "cli", "password")
+
+	var out strings.Builder
+	if err := runResetLink(context.Background(), s, []string{"cli"}, &out); err != nil {
+		t.Fatalf("reset-link failed: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), s.BaseURL+"/reset/") {
+		t.Errorf("expected a reset link, got %q", out.String())
+	}
+	if err := runResetLink(context.Background(), s, []string{"nobody"}, &out); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+}
@@ -1,17 +1,70 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// how long any one database operation gets before giving up
+const defaultOpTimeout = 5 * time.Second
+
+// posts are markdown for a short-form site; this is plenty and keeps
+// revision diffs and search cheap
+const maxPostBody = 64 << 10
+
+// how many revision diffs are kept around between page views
+const diffCacheSize = 1024
+
+var (
+	errEmptyPost   = invalid("a post needs a body")
+	errPostTooLong = invalid(fmt.Sprintf("a post can be at most %dKB", maxPostBody>>10))
+)
+
+func checkPostBody(body string) error {
+	if strings.TrimSpace(body) == "" {
+		return errEmptyPost
+	}
+	if len(body) > maxPostBody {
+		return errPostTooLong
+	}
+	return nil
+}
+
+// errTimeout is returned when an operation runs past its deadline,
+// as opposed to the client going away
+var errTimeout = errors.New("database operation timed out")
+
 type site struct {
-	p                 *persistence
-	BaseURL           string
-	Store             sessions.Store
-	ItemsPerPage      int
-	AllowRegistration bool
+	p            *persistence
+	BaseURL      string
+	Store        sessions.Store
+	ItemsPerPage int
+	OpTimeout    time.Duration
+	// header a trusted proxy puts the client's address in
+	ClientIPHeader string
+
+	// admins can change this while the site runs
+	regMu        sync.RWMutex
+	registration registrationMode
+
+	// the clock, which tests can replace. the login limiter follows
+	// it unless it's given its own.
+	now    func() time.Time
+	logins *loginLimiter
+	diffs  *diffCache
+	// the error page, parsed along with the rest when the routes
+	// are added
+	errorTmpl *page
 
 	// write operation channels
 	createUserChan    chan *createUserOp
@@ -19,18 +72,33 @@ type site struct {
 	deletePostChan    chan *deletePostOp
 	addChannelsChan   chan *addChannelsOp
 	addPostChan       chan *addPostOp
-
-	// read operation channels
-	getUserChan              chan *getUserOp
-	getPostByUUIDChan        chan *getPostByUUIDOp
-	getUserChannelsChan      chan *getUserChannelsOp
-	getAllPostsChan          chan *getAllPostsOp
-	getAllPostsInChannelChan chan *getAllPostsInChannelOp
-	getAllUserPostsChan      chan *getAllUserPostsOp
-	getChannelChan           chan *getChannelOp
-	getChannelByIDChan       chan *getChannelByIDOp
-	getPostChannelsChan      chan *getPostChannelsOp
-	searchPostsChan          chan *searchPostsOp
+	createTokenChan   chan *createTokenOp
+	touchTokenChan    chan *touchTokenOp
+	updateTokenChan   chan *updateTokenOp
+	deleteTokenChan   chan *deleteTokenOp
+	updatePostChan    chan *updatePostOp
+	loginFailureChan  chan *loginFailureOp
+	loginSuccessChan  chan *loginSuccessOp
+	passwordChan      chan *passwordOp
+	profileChan       chan *profileOp
+	createResetChan   chan *createResetOp
+	useResetChan      chan *useResetOp
+	startTOTPChan     chan *totpOp
+	enableTOTPChan    chan *totpOp
+	disableTOTPChan   chan *totpOp
+	secondFactorChan  chan *totpOp
+	createInviteChan  chan *inviteOp
+	deleteInviteChan  chan *inviteOp
+	inviteUserChan    chan *createUserOp
+	setAdminChan      chan *userFlagOp
+	setDisabledChan   chan *userFlagOp
+	siteSettingChan   chan *siteSettingOp
+	deleteUserChan    chan *deleteUserOp
+	saveSessionChan   chan *sessionOp
+	touchSessionChan  chan *sessionOp
+	deleteSessionChan chan *sessionOp
+	otherSessionsChan chan *sessionOp
+	expireSessionChan chan *sessionOp
 }
 
 func newSite(p *persistence, base string, store sessions.Store, ipp string, allowRegistration string) *site {
@@ -38,127 +106,251 @@ func newSite(p *persistence, base string, store sessions.Store, ipp string, allo
 	if err != nil {
 		i = 50
 	}
-	allowReg := false
-	if allowRegistration == "true" {
-		allowReg = true
-	}
 	s := site{
 		p:                 p,
 		BaseURL:           base,
 		Store:             store,
 		ItemsPerPage:      i,
-		AllowRegistration: allowReg,
+		registration:      parseRegistrationMode(allowRegistration),
+		OpTimeout:         defaultOpTimeout,
+		now:               time.Now,
+		logins:            newLoginLimiter(),
+		diffs:             newDiffCache(diffCacheSize),
 		createUserChan:    make(chan *createUserOp),
 		deleteChannelChan: make(chan *deleteChannelOp),
 		deletePostChan:    make(chan *deletePostOp),
 		addChannelsChan:   make(chan *addChannelsOp),
 		addPostChan:       make(chan *addPostOp),
-
-		getUserChan:              make(chan *getUserOp),
-		getPostByUUIDChan:        make(chan *getPostByUUIDOp),
-		getUserChannelsChan:      make(chan *getUserChannelsOp),
-		getAllPostsChan:          make(chan *getAllPostsOp),
-		getAllPostsInChannelChan: make(chan *getAllPostsInChannelOp),
-		getAllUserPostsChan:      make(chan *getAllUserPostsOp),
-		getChannelChan:           make(chan *getChannelOp),
-		getChannelByIDChan:       make(chan *getChannelByIDOp),
-		getPostChannelsChan:      make(chan *getPostChannelsOp),
-		searchPostsChan:          make(chan *searchPostsOp),
+		createTokenChan:   make(chan *createTokenOp),
+		touchTokenChan:    make(chan *touchTokenOp),
+		updateTokenChan:   make(chan *updateTokenOp),
+		deleteTokenChan:   make(chan *deleteTokenOp),
+		updatePostChan:    make(chan *updatePostOp),
+		loginFailureChan:  make(chan *loginFailureOp),
+		loginSuccessChan:  make(chan *loginSuccessOp),
+		passwordChan:      make(chan *passwordOp),
+		profileChan:       make(chan *profileOp),
+		createResetChan:   make(chan *createResetOp),
+		useResetChan:      make(chan *useResetOp),
+		startTOTPChan:     make(chan *totpOp),
+		enableTOTPChan:    make(chan *totpOp),
+		disableTOTPChan:   make(chan *totpOp),
+		secondFactorChan:  make(chan *totpOp),
+		createInviteChan:  make(chan *inviteOp),
+		deleteInviteChan:  make(chan *inviteOp),
+		inviteUserChan:    make(chan *createUserOp),
+		setAdminChan:      make(chan *userFlagOp),
+		setDisabledChan:   make(chan *userFlagOp),
+		siteSettingChan:   make(chan *siteSettingOp),
+		deleteUserChan:    make(chan *deleteUserOp),
+		saveSessionChan:   make(chan *sessionOp),
+		touchSessionChan:  make(chan *sessionOp),
+		deleteSessionChan: make(chan *sessionOp),
+		otherSessionsChan: make(chan *sessionOp),
+		expireSessionChan: make(chan *sessionOp),
 	}
+	s.logins.now = func() time.Time { return s.now() }
 	go s.Run()
 	return &s
 }
 
 /*
-All database operations run through here to guarantee
-that there is never more than one happening at a time.
+All database writes run through here to guarantee that there
+is never more than one happening at a time. Reads don't need
+to wait on each other or on writes (the database is in WAL
+mode), so they go straight to the persistence read pool.
 */
 func (s *site) Run() {
 	for {
 		select {
-		// reads first
-		case op := <-s.getUserChan:
-			u, err := s.p.GetUser(op.Username)
-			op.Resp <- userResponse{User: u, Err: err}
-		case op := <-s.getPostByUUIDChan:
-			p, err := s.p.GetPostByUUID(op.UUID)
-			op.Resp <- postResponse{Post: p, Err: err}
-		case op := <-s.getUserChannelsChan:
-			channels, err := s.p.GetUserChannels(op.User)
-			op.Resp <- channelsResponse{Channels: channels, Err: err}
-		case op := <-s.getAllPostsChan:
-			posts, err := s.p.GetAllPosts(op.Limit, op.Offset)
-			op.Resp <- postsResponse{Posts: posts, Err: err}
-		case op := <-s.getAllPostsInChannelChan:
-			posts, err := s.p.GetAllPostsInChannel(op.Channel, op.Limit, op.Offset)
-			op.Resp <- postsResponse{Posts: posts, Err: err}
-		case op := <-s.getAllUserPostsChan:
-			posts, err := s.p.GetAllUserPosts(op.User, op.Limit, op.Offset)
-			op.Resp <- postsResponse{Posts: posts, Err: err}
-		case op := <-s.getChannelChan:
-			channel, err := s.p.GetChannel(op.User, op.Slug)
-			op.Resp <- channelResponse{Channel: channel, Err: err}
-		case op := <-s.getChannelByIDChan:
-			channel, err := s.p.GetChannelByID(op.ID)
-			op.Resp <- channelResponse{Channel: channel, Err: err}
-		case op := <-s.getPostChannelsChan:
-			channels, err := s.p.GetPostChannels(op.Post)
-			op.Resp <- channelsResponse{Channels: channels, Err: err}
-		case op := <-s.searchPostsChan:
-			posts, err := s.p.SearchPosts(op.Q, op.Limit, op.Offset)
-			op.Resp <- postsResponse{Posts: posts, Err: err}
-
-		// then writes
 		case op := <-s.createUserChan:
-			u, err := s.p.CreateUser(op.Username, op.Password)
+			u, err := s.p.CreateUser(op.Ctx, op.Username, op.Password)
 			op.Resp <- userResponse{User: u, Err: err}
 		case op := <-s.deleteChannelChan:
-			err := s.p.DeleteChannel(op.Channel)
+			err := s.p.DeleteChannel(op.Ctx, op.Channel)
 			op.Resp <- deleteChannelResponse{Err: err}
 		case op := <-s.deletePostChan:
-			err := s.p.DeletePost(op.Post)
+			err := s.p.DeletePost(op.Ctx, op.Post)
 			op.Resp <- deletePostResponse{Err: err}
 		case op := <-s.addChannelsChan:
-			channels, err := s.p.AddChannels(op.User, op.Names)
+			channels, err := s.p.AddChannels(op.Ctx, op.User, op.Names)
 			op.Resp <- channelsResponse{Channels: channels, Err: err}
 		case op := <-s.addPostChan:
-			post, err := s.p.AddPost(op.User, op.Body, op.Channels)
+			post, err := s.p.AddPost(op.Ctx, op.User, op.Body, op.Channels)
 			op.Resp <- postResponse{Post: post, Err: err}
-
+		case op := <-s.createTokenChan:
+			token, secret, err := s.p.CreateToken(op.Ctx, op.User, op.Label)
+			op.Resp <- tokenResponse{Token: token, Secret: secret, Err: err}
+		case op := <-s.touchTokenChan:
+			err := s.p.TouchToken(op.Ctx, op.ID, op.Now)
+			op.Resp <- tokenResponse{Err: err}
+		case op := <-s.updateTokenChan:
+			err := s.p.UpdateTokenLabel(op.Ctx, op.User, op.ID, op.Label)
+			op.Resp <- tokenResponse{Err: err}
+		case op := <-s.deleteTokenChan:
+			err := s.p.DeleteToken(op.Ctx, op.User, op.ID)
+			op.Resp <- tokenResponse{Err: err}
+		case op := <-s.updatePostChan:
+			post, err := s.p.UpdatePost(op.Ctx, op.Post, op.Body, op.Channels)
+			op.Resp <- postResponse{Post: post, Err: err}
+		case op := <-s.loginFailureChan:
+			err := s.p.RecordLoginFailure(op.Ctx, op.Username, op.IP, op.Reason, op.Now)
+			op.Resp <- loginRecordResponse{Err: err}
+		case op := <-s.loginSuccessChan:
+			err := s.p.RecordLoginSuccess(op.Ctx, op.User)
+			op.Resp <- loginRecordResponse{Err: err}
+		case op := <-s.passwordChan:
+			err := s.p.UpdatePassword(op.Ctx, &op.User, op.Password, op.Keep)
+			op.Resp <- accountResponse{Err: err}
+		case op := <-s.profileChan:
+			err := s.p.UpdateProfile(op.Ctx, &op.User, op.DisplayName, op.Bio)
+			op.Resp <- accountResponse{Err: err}
+		case op := <-s.createResetChan:
+			secret, err := s.p.CreatePasswordReset(op.Ctx, &op.User, op.Now, op.Now.Add(resetLinkLifetime))
+			op.Resp <- accountResponse{Secret: secret, Err: err}
+		case op := <-s.useResetChan:
+			u, err := s.p.UsePasswordReset(op.Ctx, op.Secret, op.Password, op.Now)
+			op.Resp <- accountResponse{User: u, Err: err}
+		case op := <-s.startTOTPChan:
+			err := s.p.StartTOTP(op.Ctx, &op.User, op.Secret)
+			op.Resp <- totpResponse{Err: err}
+		case op := <-s.enableTOTPChan:
+			err := s.p.EnableTOTP(op.Ctx, &op.User, op.Step, op.CodeHashes)
+			op.Resp <- totpResponse{Err: err}
+		case op := <-s.disableTOTPChan:
+			err := s.p.DisableTOTP(op.Ctx, &op.User)
+			op.Resp <- totpResponse{Err: err}
+		case op := <-s.secondFactorChan:
+			var ok bool
+			var err error
+			if op.CodeHash != "" {
+				ok, err = s.p.UseRecoveryCode(op.Ctx, &op.User, op.CodeHash, op.Now)
+			} else {
+				ok, err = s.p.UseTOTPStep(op.Ctx, &op.User, op.Step)
+			}
+			op.Resp <- totpResponse{OK: ok, Err: err}
+		case op := <-s.createInviteChan:
+			inv, err := s.p.CreateInvite(op.Ctx, &op.User, op.CodeHash, op.MaxUses, op.Now, op.Expires)
+			op.Resp <- inviteResponse{Invite: inv, Err: err}
+		case op := <-s.deleteInviteChan:
+			err := s.p.DeleteInvite(op.Ctx, op.User, op.ID)
+			op.Resp <- inviteResponse{Err: err}
+		case op := <-s.inviteUserChan:
+			u, err := s.p.CreateInvitedUser(op.Ctx, op.Username, op.Password, op.InviteHash, op.Now)
+			op.Resp <- userResponse{User: u, Err: err}
+		case op := <-s.setAdminChan:
+			err := s.p.SetAdmin(op.Ctx, &op.User, op.Value)
+			op.Resp <- userResponse{Err: err}
+		case op := <-s.setDisabledChan:
+			err := s.p.SetDisabled(op.Ctx, &op.User, op.Value)
+			op.Resp <- userResponse{Err: err}
+		case op := <-s.siteSettingChan:
+			err := s.p.SetSetting(op.Ctx, op.Name, op.Value)
+			op.Resp <- siteSettingResponse{Err: err}
+		case op := <-s.deleteUserChan:
+			err := s.p.DeleteUser(op.Ctx, &op.User)
+			op.Resp <- userResponse{Err: err}
+		case op := <-s.saveSessionChan:
+			err := s.p.SaveSession(op.Ctx, op.Session)
+			op.Resp <- sessionResponse{Err: err}
+		case op := <-s.touchSessionChan:
+			err := s.p.TouchSession(op.Ctx, op.Session)
+			op.Resp <- sessionResponse{Err: err}
+		case op := <-s.deleteSessionChan:
+			err := s.p.DeleteSession(op.Ctx, op.Session.IDHash)
+			op.Resp <- sessionResponse{Err: err}
+		case op := <-s.otherSessionsChan:
+			n, err := s.p.DeleteOtherSessions(op.Ctx, op.User, op.Session.IDHash)
+			op.Resp <- sessionResponse{Count: n, Err: err}
+		case op := <-s.expireSessionChan:
+			n, err := s.p.DeleteExpiredSessions(op.Ctx, op.Now)
+			op.Resp <- sessionResponse{Count: n, Err: err}
 		}
 	}
 }
 
+// opContext applies the per operation deadline
+func (s *site) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.OpTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.OpTimeout)
+}
+
+// opError makes a deadline show up as errTimeout however the
+// database driver happened to report it, and marks anything that
+// persistence didn't classify as internal
+func opError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", errTimeout, err)
+	}
+	if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+	var se *siteError
+	if !errors.As(err, &se) && ctx.Err() == nil {
+		return internal(err)
+	}
+	return err
+}
+
+// call hands an op to Run and waits for the response, giving up
+// as soon as the context is done. response channels are buffered
+// so Run never blocks on an op nobody is waiting for any more.
+func call[O any, R any](ctx context.Context, ops chan<- O, op O, resp <-chan R) (R, error) {
+	var zero R
+	select {
+	case ops <- op:
+	case <-ctx.Done():
+		return zero, opError(ctx, ctx.Err())
+	}
+	select {
+	case r := <-resp:
+		return r, nil
+	case <-ctx.Done():
+		return zero, opError(ctx, ctx.Err())
+	}
+}
+
 type userResponse struct {
 	User *user
 	Err  error
 }
 
 type createUserOp struct {
+	Ctx      context.Context
 	Username string
 	Password string
-	Resp     chan userResponse
-}
-
-func (s *site) CreateUser(username, password string) (*user, error) {
-	r := make(chan userResponse)
-	cuo := &createUserOp{Username: username, Password: password, Resp: r}
-	s.createUserChan <- cuo
-	ur := <-r
-	return ur.User, ur.Err
-}
-
-type getUserOp struct {
-	Username string
-	Resp     chan userResponse
+	// only for invited users
+	InviteHash string
+	Now        time.Time
+	Resp       chan userResponse
 }
 
-func (s *site) GetUser(username string) (*user, error) {
-	r := make(chan userResponse)
-	op := &getUserOp{Username: username, Resp: r}
-	s.getUserChan <- op
-	ur := <-r
-	return ur.User, ur.Err
+// CreateUser makes an account. the username has to be one that's
+// safe to use; how strong the password is gets checked where people
+// choose one, by Register and the password forms.
+func (s *site) CreateUser(ctx context.Context, username, password string) (*user, error) {
+	errs := formErrors{}
+	errs.check("username", checkUsername(username))
+	if password == "" {
+		errs.check("password", "password is required")
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan userResponse, 1)
+	cuo := &createUserOp{Ctx: ctx, Username: username, Password: password, Resp: r}
+	ur, err := call(ctx, s.createUserChan, cuo, r)
+	if err != nil {
+		return nil, err
+	}
+	return ur.User, opError(ctx, ur.Err)
 }
 
 type deleteChannelResponse struct {
@@ -166,16 +358,21 @@ type deleteChannelResponse struct {
 }
 
 type deleteChannelOp struct {
+	Ctx     context.Context
 	Channel *channel
 	Resp    chan deleteChannelResponse
 }
 
-func (s *site) DeleteChannel(c *channel) error {
-	r := make(chan deleteChannelResponse)
-	op := &deleteChannelOp{Channel: c, Resp: r}
-	s.deleteChannelChan <- op
-	ur := <-r
-	return ur.Err
+func (s *site) DeleteChannel(ctx context.Context, c *channel) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan deleteChannelResponse, 1)
+	op := &deleteChannelOp{Ctx: ctx, Channel: c, Resp: r}
+	ur, err := call(ctx, s.deleteChannelChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ur.Err)
 }
 
 type deletePostResponse struct {
@@ -183,16 +380,21 @@ type deletePostResponse struct {
 }
 
 type deletePostOp struct {
+	Ctx  context.Context
 	Post *post
 	Resp chan deletePostResponse
 }
 
-func (s *site) DeletePost(c *post) error {
-	r := make(chan deletePostResponse)
-	op := &deletePostOp{Post: c, Resp: r}
-	s.deletePostChan <- op
-	ur := <-r
-	return ur.Err
+func (s *site) DeletePost(ctx context.Context, c *post) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan deletePostResponse, 1)
+	op := &deletePostOp{Ctx: ctx, Post: c, Resp: r}
+	ur, err := call(ctx, s.deletePostChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ur.Err)
 }
 
 type channelsResponse struct {
@@ -201,170 +403,1015 @@ type channelsResponse struct {
 }
 
 type addChannelsOp struct {
+	Ctx   context.Context
 	User  user
 	Names []string
 	Resp  chan channelsResponse
 }
 
-func (s *site) AddChannels(u user, names []string) ([]*channel, error) {
-	r := make(chan channelsResponse)
-	op := &addChannelsOp{User: u, Names: names, Resp: r}
-	s.addChannelsChan <- op
-	ur := <-r
-	return ur.Channels, ur.Err
+func (s *site) AddChannels(ctx context.Context, u user, names []string) ([]*channel, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan channelsResponse, 1)
+	op := &addChannelsOp{Ctx: ctx, User: u, Names: names, Resp: r}
+	ur, err := call(ctx, s.addChannelsChan, op, r)
+	if err != nil {
+		return nil, err
+	}
+	return ur.Channels, opError(ctx, ur.Err)
 }
 
-type getPostChannelsOp struct {
+type postResponse struct {
 	Post *post
-	Resp chan channelsResponse
+	Err  error
 }
 
-func (s *site) GetPostChannels(p *post) ([]*channel, error) {
-	r := make(chan channelsResponse)
-	op := &getPostChannelsOp{Post: p, Resp: r}
-	s.getPostChannelsChan <- op
-	ur := <-r
-	return ur.Channels, ur.Err
+type addPostOp struct {
+	Ctx      context.Context
+	User     user
+	Body     string
+	Channels []*channel
+	Resp     chan postResponse
 }
 
-type channelResponse struct {
-	Channel *channel
-	Err     error
+func (s *site) AddPost(ctx context.Context, u user, body string, channels []*channel) (*post, error) {
+	if err := checkPostBody(body); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan postResponse, 1)
+	op := &addPostOp{Ctx: ctx, User: u, Body: body, Channels: channels, Resp: r}
+	ur, err := call(ctx, s.addPostChan, op, r)
+	if err != nil {
+		return nil, err
+	}
+	return ur.Post, opError(ctx, ur.Err)
 }
 
-type getChannelOp struct {
-	User user
-	Slug string
-	Resp chan channelResponse
+type updatePostOp struct {
+	Ctx      context.Context
+	Post     *post
+	Body     string
+	Channels []*channel
+	Resp     chan postResponse
 }
 
-func (s *site) GetChannel(u user, slug string) (*channel, error) {
-	r := make(chan channelResponse)
-	op := &getChannelOp{User: u, Slug: slug, Resp: r}
-	s.getChannelChan <- op
-	ur := <-r
-	return ur.Channel, ur.Err
+func (s *site) UpdatePost(ctx context.Context, p *post, body string, channels []*channel) (*post, error) {
+	if err := checkPostBody(body); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan postResponse, 1)
+	op := &updatePostOp{Ctx: ctx, Post: p, Body: body, Channels: channels, Resp: r}
+	ur, err := call(ctx, s.updatePostChan, op, r)
+	if err != nil {
+		return nil, err
+	}
+	return ur.Post, opError(ctx, ur.Err)
 }
 
-type getChannelByIDOp struct {
+type tokenResponse struct {
+	Token  *apiToken
+	Secret string
+	Err    error
+}
+
+type createTokenOp struct {
+	Ctx   context.Context
+	User  user
+	Label string
+	Resp  chan tokenResponse
+}
+
+// CreateToken returns the new token along with its plaintext
+// secret, which is not stored anywhere and can't be recovered
+func (s *site) CreateToken(ctx context.Context, u user, label string) (*apiToken, string, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan tokenResponse, 1)
+	op := &createTokenOp{Ctx: ctx, User: u, Label: label, Resp: r}
+	tr, err := call(ctx, s.createTokenChan, op, r)
+	if err != nil {
+		return nil, "", err
+	}
+	return tr.Token, tr.Secret, opError(ctx, tr.Err)
+}
+
+type touchTokenOp struct {
+	Ctx  context.Context
 	ID   int
-	Resp chan channelResponse
+	Now  time.Time
+	Resp chan tokenResponse
+}
+
+// UseToken looks up the owner of a token. the last used time is
+// only written once it's tokenTouchEvery out of date, so API reads
+// don't all queue up behind the writer.
+func (s *site) UseToken(ctx context.Context, secret string) (*user, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	t, err := s.p.GetToken(ctx, secret)
+	if err := opError(ctx, err); err != nil {
+		return nil, err
+	}
+	if t.User.Disabled {
+		return nil, errAccountDisabled
+	}
+	now := s.now()
+	if now.Sub(t.LastUsedTime()) >= tokenTouchEvery {
+		r := make(chan tokenResponse, 1)
+		op := &touchTokenOp{Ctx: ctx, ID: t.ID, Now: now, Resp: r}
+		tr, err := call(ctx, s.touchTokenChan, op, r)
+		if err == nil {
+			err = opError(ctx, tr.Err)
+		}
+		if err != nil {
+			// still a good token
+			log.Printf("touching token: %v", err)
+		}
+	}
+	return t.User, nil
 }
 
-func (s *site) GetChannelByID(id int) (*channel, error) {
-	r := make(chan channelResponse)
-	op := &getChannelByIDOp{ID: id, Resp: r}
-	s.getChannelByIDChan <- op
-	ur := <-r
-	return ur.Channel, ur.Err
+type updateTokenOp struct {
+	Ctx   context.Context
+	User  user
+	ID    int
+	Label string
+	Resp  chan tokenResponse
 }
 
-type getUserChannelsOp struct {
+func (s *site) UpdateTokenLabel(ctx context.Context, u user, id int, label string) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan tokenResponse, 1)
+	op := &updateTokenOp{Ctx: ctx, User: u, ID: id, Label: label, Resp: r}
+	tr, err := call(ctx, s.updateTokenChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, tr.Err)
+}
+
+type deleteTokenOp struct {
+	Ctx  context.Context
 	User user
-	Resp chan channelsResponse
+	ID   int
+	Resp chan tokenResponse
 }
 
-func (s *site) GetUserChannels(u user) ([]*channel, error) {
-	r := make(chan channelsResponse)
-	op := &getUserChannelsOp{User: u, Resp: r}
-	s.getUserChannelsChan <- op
-	ur := <-r
-	return ur.Channels, ur.Err
+func (s *site) DeleteToken(ctx context.Context, u user, id int) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan tokenResponse, 1)
+	op := &deleteTokenOp{Ctx: ctx, User: u, ID: id, Resp: r}
+	tr, err := call(ctx, s.deleteTokenChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, tr.Err)
 }
 
-type postResponse struct {
-	Post *post
-	Err  error
+type loginRecordResponse struct {
+	Err error
 }
 
-type addPostOp struct {
+type loginFailureOp struct {
+	Ctx      context.Context
+	Username string
+	IP       string
+	Reason   string
+	Now      time.Time
+	Resp     chan loginRecordResponse
+}
+
+func (s *site) RecordLoginFailure(ctx context.Context, username, ip, reason string) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan loginRecordResponse, 1)
+	op := &loginFailureOp{Ctx: ctx, Username: username, IP: ip, Reason: reason, Now: s.logins.now(), Resp: r}
+	lr, err := call(ctx, s.loginFailureChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, lr.Err)
+}
+
+type loginSuccessOp struct {
+	Ctx  context.Context
+	User *user
+	Resp chan loginRecordResponse
+}
+
+func (s *site) RecordLoginSuccess(ctx context.Context, u *user) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan loginRecordResponse, 1)
+	op := &loginSuccessOp{Ctx: ctx, User: u, Resp: r}
+	lr, err := call(ctx, s.loginSuccessChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, lr.Err)
+}
+
+// Login checks a username and password from the given IP. it
+// returns errBadLogin whether the user doesn't exist or the password
+// is wrong, and errTooManyAttempts while the IP or username is
+// backing off or the account is locked.
+func (s *site) Login(ctx context.Context, username, password, ip string) (*user, error) {
+	ipKey, userKey := "ip:"+ip, "user:"+strings.ToLower(username)
+	if s.logins.Wait(ipKey, userKey) > 0 {
+		return nil, errTooManyAttempts
+	}
+
+	u, err := s.GetUser(ctx, username)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	if u != nil && int64(u.LockedUntil) > s.logins.now().Unix() {
+		if err := s.RecordLoginFailure(ctx, username, ip, loginLocked); err != nil {
+			return nil, err
+		}
+		return nil, errTooManyAttempts
+	}
+
+	reason := ""
+	if u == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		reason = loginUnknownUser
+	} else if !u.CheckPassword(password) {
+		reason = loginBadPassword
+	}
+	if reason != "" {
+		s.logins.Fail(ipKey, userKey)
+		if err := s.RecordLoginFailure(ctx, username, ip, reason); err != nil {
+			return nil, err
+		}
+		return nil, errBadLogin
+	}
+
+	if u.Disabled {
+		if err := s.RecordLoginFailure(ctx, username, ip, loginDisabled); err != nil {
+			return nil, err
+		}
+		return nil, errAccountDisabled
+	}
+
+	// with two factor auth on, the login isn't a success until
+	// VerifySecondFactor. otherwise someone with the password could
+	// keep resetting the lockout while guessing codes.
+	if u.TOTPEnabled {
+		return u, nil
+	}
+	return u, s.loginSucceeded(ctx, u)
+}
+
+func (s *site) loginSucceeded(ctx context.Context, u *user) error {
+	// only the username is let off; one good login shouldn't wipe
+	// the slate for everything else tried from that address
+	s.logins.Reset("user:" + strings.ToLower(u.Username))
+	return s.RecordLoginSuccess(ctx, u)
+}
+
+// reads
+
+func (s *site) GetUser(ctx context.Context, username string) (*user, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetUser(ctx, username)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetPostByUUID(ctx context.Context, uu string) (*post, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetPostByUUID(ctx, uu)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetPostChannels(ctx context.Context, p *post) ([]*channel, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetPostChannels(ctx, p)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetPostRevisions(ctx context.Context, p *post) ([]*revision, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetPostRevisions(ctx, p)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetChannel(ctx context.Context, u user, slug string) (*channel, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetChannel(ctx, u, slug)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetChannelByID(ctx context.Context, id int) (*channel, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetChannelByID(ctx, id)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetUserChannels(ctx context.Context, u user) ([]*channel, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetUserChannels(ctx, u)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetUserTokens(ctx context.Context, u user) ([]*apiToken, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetUserTokens(ctx, u)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetAllPosts(ctx context.Context, limit, offset int) ([]*post, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetAllPosts(ctx, limit, offset)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetAllPostsInChannel(ctx context.Context, c channel, limit, offset int) ([]*post, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetAllPostsInChannel(ctx, c, limit, offset)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetAllUserPosts(ctx context.Context, u *user, limit, offset int) ([]*post, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetAllUserPosts(ctx, u, limit, offset)
+	return v, opError(ctx, err)
+}
+
+func (s *site) SearchPosts(ctx context.Context, q searchQuery, limit, offset int) ([]*post, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.SearchPosts(ctx, q, limit, offset)
+	return v, opError(ctx, err)
+}
+
+func (s *site) GetLoginAttempts(ctx context.Context, username string, limit int) ([]*loginAttempt, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetLoginAttempts(ctx, username, limit)
+	return v, opError(ctx, err)
+}
+
+type accountResponse struct {
+	User   *user
+	Secret string
+	Err    error
+}
+
+type passwordOp struct {
+	Ctx      context.Context
 	User     user
-	Body     string
-	Channels []*channel
-	Resp     chan postResponse
+	Password string
+	// id hash of the session to stay logged in
+	Keep string
+	Resp chan accountResponse
 }
 
-func (s *site) AddPost(u user, body string, channels []*channel) (*post, error) {
-	r := make(chan postResponse)
-	op := &addPostOp{User: u, Body: body, Channels: channels, Resp: r}
-	s.addPostChan <- op
-	ur := <-r
-	return ur.Post, ur.Err
+// ChangePassword checks the user's current password before setting
+// the new one. every other session the user has, and every API
+// token, stops working; keep is the id hash of the one that made
+// the change.
+func (s *site) ChangePassword(ctx context.Context, u user, keep, current, password, confirm string) error {
+	errs := formErrors{}
+	if !u.CheckPassword(current) {
+		errs.check("current", "current password is incorrect")
+	}
+	errs.check("password", checkPassword(password, u.Username))
+	if password != confirm {
+		errs.check("confirm", "new passwords don't match")
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	return s.setPassword(ctx, u, password, keep)
 }
 
-type getPostByUUIDOp struct {
-	UUID string
-	Resp chan postResponse
+func (s *site) setPassword(ctx context.Context, u user, password, keep string) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan accountResponse, 1)
+	op := &passwordOp{Ctx: ctx, User: u, Password: password, Keep: keep, Resp: r}
+	ar, err := call(ctx, s.passwordChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ar.Err)
 }
 
-func (s *site) GetPostByUUID(uu string) (*post, error) {
-	r := make(chan postResponse)
-	op := &getPostByUUIDOp{UUID: uu, Resp: r}
-	s.getPostByUUIDChan <- op
-	ur := <-r
-	return ur.Post, ur.Err
+const (
+	maxDisplayName = 64
+	maxBio         = 1000
+)
+
+type profileOp struct {
+	Ctx         context.Context
+	User        user
+	DisplayName string
+	Bio         string
+	Resp        chan accountResponse
 }
 
-type postsResponse struct {
-	Posts []*post
+func (s *site) UpdateProfile(ctx context.Context, u user, displayName, bio string) error {
+	displayName = strings.TrimSpace(displayName)
+	bio = strings.TrimSpace(bio)
+	errs := formErrors{}
+	if utf8.RuneCountInString(displayName) > maxDisplayName {
+		errs.check("display_name", fmt.Sprintf("display name can be at most %d characters", maxDisplayName))
+	}
+	if utf8.RuneCountInString(bio) > maxBio {
+		errs.check("bio", fmt.Sprintf("bio can be at most %d characters", maxBio))
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan accountResponse, 1)
+	op := &profileOp{Ctx: ctx, User: u, DisplayName: displayName, Bio: bio, Resp: r}
+	ar, err := call(ctx, s.profileChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ar.Err)
+}
+
+// how long a password reset link works for
+const resetLinkLifetime = 24 * time.Hour
+
+type createResetOp struct {
+	Ctx  context.Context
+	User user
+	Now  time.Time
+	Resp chan accountResponse
+}
+
+// CreateResetLink returns a one time link that lets whoever has it
+// set a new password for the user. there's no email, so an admin
+// hands it over.
+func (s *site) CreateResetLink(ctx context.Context, u user) (string, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan accountResponse, 1)
+	op := &createResetOp{Ctx: ctx, User: u, Now: s.now(), Resp: r}
+	ar, err := call(ctx, s.createResetChan, op, r)
+	if err != nil {
+		return "", err
+	}
+	if err := opError(ctx, ar.Err); err != nil {
+		return "", err
+	}
+	return s.BaseURL + "/reset/" + ar.Secret + "/", nil
+}
+
+// GetResetUser is who a reset link is for, if it's still good
+func (s *site) GetResetUser(ctx context.Context, secret string) (*user, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	u, err := s.p.GetPasswordReset(ctx, secret, s.now())
+	return u, opError(ctx, err)
+}
+
+type useResetOp struct {
+	Ctx      context.Context
+	Secret   string
+	Password string
+	Now      time.Time
+	Resp     chan accountResponse
+}
+
+func (s *site) ResetPassword(ctx context.Context, secret, password, confirm string) (*user, error) {
+	// the link is checked again when it's used up, but the
+	// password check needs to know whose it is
+	u, err := s.GetResetUser(ctx, secret)
+	if err != nil {
+		return nil, err
+	}
+	errs := formErrors{}
+	errs.check("password", checkPassword(password, u.Username))
+	if password != confirm {
+		errs.check("confirm", "new passwords don't match")
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan accountResponse, 1)
+	op := &useResetOp{Ctx: ctx, Secret: secret, Password: password, Now: s.now(), Resp: r}
+	ar, err := call(ctx, s.useResetChan, op, r)
+	if err != nil {
+		return nil, err
+	}
+	if ar.Err != nil {
+		return nil, opError(ctx, ar.Err)
+	}
+	// the database lockout was lifted along with the new password
+	s.logins.Reset("user:" + strings.ToLower(ar.User.Username))
+	return ar.User, nil
+}
+
+type totpResponse struct {
+	OK  bool
+	Err error
+}
+
+type totpOp struct {
+	Ctx        context.Context
+	User       user
+	Secret     string
+	Step       int64
+	CodeHash   string
+	CodeHashes []string
+	Now        time.Time
+	Resp       chan totpResponse
+}
+
+func (s *site) totpCall(ctx context.Context, ops chan *totpOp, op *totpOp) (bool, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan totpResponse, 1)
+	op.Ctx, op.Resp = ctx, r
+	tr, err := call(ctx, ops, op, r)
+	if err != nil {
+		return false, err
+	}
+	return tr.OK, opError(ctx, tr.Err)
+}
+
+// StartTOTP gives the user a new secret to put in their
+// authenticator app. it's pending until ConfirmTOTP.
+func (s *site) StartTOTP(ctx context.Context, u user) error {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return internal(err)
+	}
+	_, err = s.totpCall(ctx, s.startTOTPChan, &totpOp{User: u, Secret: secret})
+	return err
+}
+
+// ConfirmTOTP turns two factor auth on once the user shows a code
+// from the pending secret. it returns their recovery codes, which
+// are only ever available here.
+func (s *site) ConfirmTOTP(ctx context.Context, u user, code string) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, conflict("two factor authentication is already on", nil)
+	}
+	if u.TOTPSecret == "" {
+		return nil, invalid("two factor authentication setup hasn't been started")
+	}
+	step, ok := totpMatch(u.TOTPSecret, code, s.now(), 0)
+	if !ok {
+		return nil, invalid("that code didn't match. check the time on your device and try again")
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, internal(err)
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = hashToken(c)
+	}
+	_, err = s.totpCall(ctx, s.enableTOTPChan, &totpOp{User: u, Step: step, CodeHashes: hashes})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two factor auth off, or cancels a setup that
+// was never confirmed. turning it off takes the password.
+func (s *site) DisableTOTP(ctx context.Context, u user, password string) error {
+	if u.TOTPEnabled && !u.CheckPassword(password) {
+		return invalid("password is incorrect")
+	}
+	_, err := s.totpCall(ctx, s.disableTOTPChan, &totpOp{User: u})
+	return err
+}
+
+func (s *site) CountRecoveryCodes(ctx context.Context, u user) (int, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	n, err := s.p.CountRecoveryCodes(ctx, u)
+	return n, opError(ctx, err)
+}
+
+// VerifySecondFactor finishes a login for a user with two factor
+// auth, taking either a code from their authenticator or one of
+// their recovery codes. failures count towards the same backoff and
+// lockout as bad passwords.
+func (s *site) VerifySecondFactor(ctx context.Context, username, code, ip string) (*user, error) {
+	ipKey, userKey := "ip:"+ip, "user:"+strings.ToLower(username)
+	if s.logins.Wait(ipKey, userKey) > 0 {
+		return nil, errTooManyAttempts
+	}
+	u, err := s.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, errAccountDisabled
+	}
+	now := s.now()
+	if int64(u.LockedUntil) > now.Unix() {
+		if err := s.RecordLoginFailure(ctx, username, ip, loginLocked); err != nil {
+			return nil, err
+		}
+		return nil, errTooManyAttempts
+	}
+
+	ok, err := s.checkSecondFactor(ctx, u, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		s.logins.Fail(ipKey, userKey)
+		if err := s.RecordLoginFailure(ctx, username, ip, loginBadCode); err != nil {
+			return nil, err
+		}
+		return nil, errBadCode
+	}
+	return u, s.loginSucceeded(ctx, u)
+}
+
+// checkSecondFactor uses up the code if it's good, so it can't be
+// used again
+func (s *site) checkSecondFactor(ctx context.Context, u *user, code string, now time.Time) (bool, error) {
+	if !u.TOTPEnabled {
+		return false, nil
+	}
+	if step, ok := totpMatch(u.TOTPSecret, code, now, u.TOTPLastStep); ok {
+		return s.totpCall(ctx, s.secondFactorChan, &totpOp{User: *u, Step: step})
+	}
+	if c := normalizeRecoveryCode(code); c != "" {
+		return s.totpCall(ctx, s.secondFactorChan, &totpOp{User: *u, CodeHash: hashToken(c), Now: now})
+	}
+	return false, nil
+}
+
+// RegistrationOpen is whether the register page is there at all,
+// though in invite mode it takes a code
+func (s *site) RegistrationOpen() bool {
+	return s.Registration() != registrationClosed
+}
+
+// Register creates an account from the register page, which takes
+// an invite code depending on the registration mode. with open
+// registration a code is optional, but still records the inviter.
+func (s *site) Register(ctx context.Context, username, password, confirm, code string) (*user, error) {
+	if s.Registration() == registrationClosed {
+		return nil, forbidden("registration is closed")
+	}
+	code = normalizeInviteCode(code)
+	errs := formErrors{}
+	errs.check("username", checkUsername(username))
+	errs.check("password", checkPassword(password, username))
+	if password != confirm {
+		errs.check("confirm", "passwords don't match")
+	}
+	if code == "" && s.Registration() == registrationInvite {
+		errs.check("invite", "an invite code is required to register")
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	if code == "" {
+		return s.CreateUser(ctx, username, password)
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan userResponse, 1)
+	op := &createUserOp{Ctx: ctx, Username: username, Password: password,
+		InviteHash: hashToken(code), Now: s.now(), Resp: r}
+	ur, err := call(ctx, s.inviteUserChan, op, r)
+	if err != nil {
+		return nil, err
+	}
+	return ur.User, opError(ctx, ur.Err)
+}
+
+type inviteResponse struct {
+	Invite *invite
+	Err    error
+}
+
+type inviteOp struct {
+	Ctx      context.Context
+	User     user
+	ID       int
+	CodeHash string
+	MaxUses  int
+	Now      time.Time
+	Expires  time.Time
+	Resp     chan inviteResponse
+}
+
+// CreateInvite returns the new invite along with its code, which
+// isn't stored anywhere
+func (s *site) CreateInvite(ctx context.Context, u user, maxUses int, lifetime time.Duration) (*invite, string, error) {
+	if s.Registration() != registrationInvite {
+		return nil, "", forbidden("invites are only used when registration is invite only")
+	}
+	if maxUses < 1 || maxUses > maxInviteUses {
+		return nil, "", invalid(fmt.Sprintf("an invite can be used between 1 and %d times", maxInviteUses))
+	}
+	if lifetime <= 0 || lifetime > maxInviteLifetime {
+		return nil, "", invalid(fmt.Sprintf("an invite can last up to %d days", maxInviteLifetime/(24*time.Hour)))
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return nil, "", internal(err)
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	now := s.now()
+	r := make(chan inviteResponse, 1)
+	op := &inviteOp{Ctx: ctx, User: u, CodeHash: hashToken(code), MaxUses: maxUses,
+		Now: now, Expires: now.Add(lifetime), Resp: r}
+	ir, err := call(ctx, s.createInviteChan, op, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := opError(ctx, ir.Err); err != nil {
+		return nil, "", err
+	}
+	return ir.Invite, code, nil
+}
+
+func (s *site) DeleteInvite(ctx context.Context, u user, id int) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan inviteResponse, 1)
+	op := &inviteOp{Ctx: ctx, User: u, ID: id, Resp: r}
+	ir, err := call(ctx, s.deleteInviteChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ir.Err)
+}
+
+func (s *site) GetUserInvites(ctx context.Context, u user) ([]*invite, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	invites, err := s.p.GetUserInvites(ctx, u)
+	return invites, opError(ctx, err)
+}
+
+func (s *site) GetInvitees(ctx context.Context, u user) ([]string, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	names, err := s.p.GetInvitees(ctx, u)
+	return names, opError(ctx, err)
+}
+
+// Registration is the current registration mode
+func (s *site) Registration() registrationMode {
+	s.regMu.RLock()
+	defer s.regMu.RUnlock()
+	return s.registration
+}
+
+// the name of the registration mode in site_setting
+const registrationSetting = "registration"
+
+type siteSettingResponse struct {
+	Err error
+}
+
+type siteSettingOp struct {
+	Ctx   context.Context
+	Name  string
+	Value string
+	Resp  chan siteSettingResponse
+}
+
+// SetRegistration changes the registration mode, and saves it so
+// it outlasts a restart
+func (s *site) SetRegistration(ctx context.Context, mode registrationMode) error {
+	switch mode {
+	case registrationOpen, registrationInvite, registrationClosed:
+	default:
+		return invalid("unknown registration mode")
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan siteSettingResponse, 1)
+	op := &siteSettingOp{Ctx: ctx, Name: registrationSetting, Value: string(mode), Resp: r}
+	sr, err := call(ctx, s.siteSettingChan, op, r)
+	if err != nil {
+		return err
+	}
+	if err := opError(ctx, sr.Err); err != nil {
+		return err
+	}
+	s.regMu.Lock()
+	s.registration = mode
+	s.regMu.Unlock()
+	return nil
+}
+
+// LoadSettings applies settings saved by admins over the ones from
+// the environment
+func (s *site) LoadSettings(ctx context.Context) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetSetting(ctx, registrationSetting)
+	if err != nil {
+		return opError(ctx, err)
+	}
+	if v != "" {
+		s.regMu.Lock()
+		s.registration = parseRegistrationMode(v)
+		s.regMu.Unlock()
+	}
+	return nil
+}
+
+type userFlagOp struct {
+	Ctx   context.Context
+	User  user
+	Value bool
+	Resp  chan userResponse
+}
+
+func (s *site) setUserFlag(ctx context.Context, ops chan *userFlagOp, u user, value bool) error {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan userResponse, 1)
+	op := &userFlagOp{Ctx: ctx, User: u, Value: value, Resp: r}
+	ur, err := call(ctx, ops, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ur.Err)
+}
+
+// SetAdmin makes a user an admin, or stops them being one. it's
+// for the command line, so it doesn't need an admin to do it.
+func (s *site) SetAdmin(ctx context.Context, u user, admin bool) error {
+	return s.setUserFlag(ctx, s.setAdminChan, u, admin)
+}
+
+// SetDisabled is for an admin to disable or re-enable an account.
+// admins can't disable themselves, so there's always a way back.
+func (s *site) SetDisabled(ctx context.Context, admin user, u user, disabled bool) error {
+	if !admin.IsAdmin {
+		return forbidden("only admins can do that")
+	}
+	if admin.ID == u.ID {
+		return invalid("you can't disable your own account")
+	}
+	return s.setUserFlag(ctx, s.setDisabledChan, u, disabled)
+}
+
+func (s *site) GetUsers(ctx context.Context, limit, offset int) ([]*user, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	users, err := s.p.GetUsers(ctx, limit, offset)
+	return users, opError(ctx, err)
+}
+
+func (s *site) GetRecentChannels(ctx context.Context, limit int) ([]*channel, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	channels, err := s.p.GetRecentChannels(ctx, limit)
+	return channels, opError(ctx, err)
+}
+
+// GetVisibleUser is GetUser for public pages, where disabled
+// accounts don't exist
+func (s *site) GetVisibleUser(ctx context.Context, username string) (*user, error) {
+	u, err := s.GetUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, notFound("user", nil)
+	}
+	return u, nil
+}
+
+// GetVisiblePost is GetPostByUUID for public pages, where posts by
+// disabled accounts don't exist
+func (s *site) GetVisiblePost(ctx context.Context, uu string) (*post, error) {
+	p, err := s.GetPostByUUID(ctx, uu)
+	if err != nil {
+		return nil, err
+	}
+	if p.User.Disabled {
+		return nil, notFound("post", nil)
+	}
+	return p, nil
+}
+
+type deleteUserOp struct {
+	Ctx  context.Context
+	User user
+	Resp chan userResponse
+}
+
+// DeleteAccount is for users deleting their own account, along with
+// all their posts and channels. they have to give their password
+// and type their username to show they mean it.
+func (s *site) DeleteAccount(ctx context.Context, u user, password, confirm string) error {
+	errs := formErrors{}
+	if !u.CheckPassword(password) {
+		errs.check("password", "password is incorrect")
+	}
+	if confirm != u.Username {
+		errs.check("confirm", "type your username to confirm")
+	}
+	if err := errs.err(); err != nil {
+		return err
+	}
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan userResponse, 1)
+	op := &deleteUserOp{Ctx: ctx, User: u, Resp: r}
+	ur, err := call(ctx, s.deleteUserChan, op, r)
+	if err != nil {
+		return err
+	}
+	return opError(ctx, ur.Err)
+}
+
+type sessionOp struct {
+	Ctx     context.Context
+	Session userSession
+	User    user
+	Now     time.Time
+	Resp    chan sessionResponse
+}
+
+type sessionResponse struct {
+	Count int
 	Err   error
 }
 
-type getAllPostsOp struct {
-	Limit  int
-	Offset int
-	Resp   chan postsResponse
+func (s *site) sessionCall(ctx context.Context, ops chan *sessionOp, op *sessionOp) (int, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	r := make(chan sessionResponse, 1)
+	op.Ctx, op.Resp = ctx, r
+	sr, err := call(ctx, ops, op, r)
+	if err != nil {
+		return 0, err
+	}
+	return sr.Count, opError(ctx, sr.Err)
 }
 
-func (s *site) GetAllPosts(limit, offset int) ([]*post, error) {
-	r := make(chan postsResponse)
-	op := &getAllPostsOp{Limit: limit, Offset: offset, Resp: r}
-	s.getAllPostsChan <- op
-	ur := <-r
-	return ur.Posts, ur.Err
+func (s *site) GetSession(ctx context.Context, idHash string) (*userSession, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	us, err := s.p.GetSession(ctx, idHash, s.now())
+	return us, opError(ctx, err)
 }
 
-type getAllPostsInChannelOp struct {
-	Channel channel
-	Limit   int
-	Offset  int
-	Resp    chan postsResponse
+func (s *site) GetUserSessions(ctx context.Context, u user) ([]*userSession, error) {
+	ctx, cancel := s.opContext(ctx)
+	defer cancel()
+	v, err := s.p.GetUserSessions(ctx, u, s.now())
+	return v, opError(ctx, err)
 }
 
-func (s *site) GetAllPostsInChannel(c channel, limit, offset int) ([]*post, error) {
-	r := make(chan postsResponse)
-	op := &getAllPostsInChannelOp{Channel: c, Limit: limit, Offset: offset, Resp: r}
-	s.getAllPostsInChannelChan <- op
-	ur := <-r
-	return ur.Posts, ur.Err
+func (s *site) SaveSession(ctx context.Context, us userSession) error {
+	_, err := s.sessionCall(ctx, s.saveSessionChan, &sessionOp{Session: us})
+	return err
 }
 
-type searchPostsOp struct {
-	Q      string
-	Limit  int
-	Offset int
-	Resp   chan postsResponse
+func (s *site) TouchSession(ctx context.Context, us userSession) error {
+	_, err := s.sessionCall(ctx, s.touchSessionChan, &sessionOp{Session: us})
+	return err
 }
 
-func (s *site) SearchPosts(q string, limit, offset int) ([]*post, error) {
-	r := make(chan postsResponse)
-	op := &searchPostsOp{Q: q, Limit: limit, Offset: offset, Resp: r}
-	s.searchPostsChan <- op
-	ur := <-r
-	return ur.Posts, ur.Err
+func (s *site) DeleteSession(ctx context.Context, idHash string) error {
+	_, err := s.sessionCall(ctx, s.deleteSessionChan, &sessionOp{Session: userSession{IDHash: idHash}})
+	return err
 }
 
-type getAllUserPostsOp struct {
-	User   *user
-	Limit  int
-	Offset int
-	Resp   chan postsResponse
+// LogoutOtherSessions ends all of a user's sessions except the one
+// with the given id hash
+func (s *site) LogoutOtherSessions(ctx context.Context, u user, current string) (int, error) {
+	op := &sessionOp{User: u, Session: userSession{IDHash: current}}
+	return s.sessionCall(ctx, s.otherSessionsChan, op)
 }
 
-func (s *site) GetAllUserPosts(u *user, limit, offset int) ([]*post, error) {
-	r := make(chan postsResponse)
-	op := &getAllUserPostsOp{User: u, Limit: limit, Offset: offset, Resp: r}
-	s.getAllUserPostsChan <- op
-	ur := <-r
-	return ur.Posts, ur.Err
+func (s *site) DeleteExpiredSessions(ctx context.Context) (int, error) {
+	return s.sessionCall(ctx, s.expireSessionChan, &sessionOp{Now: s.now()})
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gorilla/sessions"
 )
@@ -16,7 +21,7 @@ func TestSiteOperations(t *testing.T) {
 	s := newSite(p, "http://localhost:8000", store, "10", "true")
 
 	// Create user via site
-	u, err := s.CreateUser("siteuser", "sitepass")
+	u, err := s.CreateUser(context.Background(), "siteuser", "sitepass")
 	if err != nil {
 		t.Fatalf("CreateUser failed: %v", err)
 	}
@@ -25,7 +30,7 @@ func TestSiteOperations(t *testing.T) {
 	}
 
 	// Get user via site
-	fetchedUser, err := s.GetUser("siteuser")
+	fetchedUser, err := s.GetUser(context.Background(), "siteuser")
 	if err != nil {
 		t.Fatalf("GetUser failed: %v", err)
 	}
@@ -35,7 +40,7 @@ func TestSiteOperations(t *testing.T) {
 
 	// Add channels
 	names := []string{"Site Channel", "Another Channel"}
-	channels, err := s.AddChannels(*u, names)
+	channels, err := s.AddChannels(context.Background(), *u, names)
 	if err != nil {
 		t.Fatalf("AddChannels failed: %v", err)
 	}
@@ -44,7 +49,7 @@ func TestSiteOperations(t *testing.T) {
 	}
 
 	// Get channel by ID and Slug
-	fetchedChannel, err := s.GetChannelByID(channels[0].ID)
+	fetchedChannel, err := s.GetChannelByID(context.Background(), channels[0].ID)
 	if err != nil {
 		t.Fatalf("GetChannelByID failed: %v", err)
 	}
@@ -52,7 +57,7 @@ func TestSiteOperations(t *testing.T) {
 		t.Errorf("Expected label 'Site Channel', got %q", fetchedChannel.Label)
 	}
 
-	fetchedChannelBySlug, err := s.GetChannel(*u, "site_channel")
+	fetchedChannelBySlug, err := s.GetChannel(context.Background(), *u, "site_channel")
 	if err != nil {
 		t.Fatalf("GetChannel failed: %v", err)
 	}
@@ -61,7 +66,7 @@ func TestSiteOperations(t *testing.T) {
 	}
 
 	// Add Post
-	post, err := s.AddPost(*u, "Site post body", channels)
+	post, err := s.AddPost(context.Background(), *u, "Site post body", channels)
 	if err != nil {
 		t.Fatalf("AddPost failed: %v", err)
 	}
@@ -72,7 +77,7 @@ func TestSiteOperations(t *testing.T) {
 	}
 
 	// Get all posts
-	posts, err := s.GetAllPosts(10, 0)
+	posts, err := s.GetAllPosts(context.Background(), 10, 0)
 	if err != nil {
 		t.Fatalf("GetAllPosts failed: %v", err)
 	}
@@ -81,7 +86,7 @@ func TestSiteOperations(t *testing.T) {
 	}
 
 	// Search posts
-	searchPosts, err := s.SearchPosts("Site post", 10, 0)
+	searchPosts, err := s.SearchPosts(context.Background(), searchQuery{Text: "Site post"}, 10, 0)
 	if err != nil {
 		t.Fatalf("SearchPosts failed: %v", err)
 	}
@@ -90,12 +95,12 @@ func TestSiteOperations(t *testing.T) {
 	}
 
 	// Delete Channel
-	err = s.DeleteChannel(channels[1])
+	err = s.DeleteChannel(context.Background(), channels[1])
 	if err != nil {
 		t.Fatalf("DeleteChannel failed: %v", err)
 	}
 
-	userChannels, err := s.GetUserChannels(*u)
+	userChannels, err := s.GetUserChannels(context.Background(), *u)
 	if err != nil {
 		t.Fatalf("GetUserChannels failed: %v", err)
 	}
@@ -103,3 +108,157 @@ func TestSiteOperations(t *testing.T) {
 		t.Fatalf("Expected 1 user channel after delete, got %d", len(userChannels))
 	}
 }
+
+func TestSiteReadsDontWaitForWrites(t *testing.T) {
+	p, cleanup := setupFileDB(t)
+	defer cleanup()
+	s := newSite(p, "http://localhost:8000", sessions.NewCookieStore([]byte("secret")), "10", "true")
+	u, _ := s.CreateUser(context.Background(), "reader", "password")
+	s.AddPost(context.Background(), *u, "already here", nil)
+
+	// hold the writer connection in the middle of a transaction
+	tx, err := p.Database.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`insert into post (uuid, user_id, body, posted) values ('x', ?, 'pending', 0)`, u.ID); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+
+	done := make(chan []*post)
+	go func() {
+		posts, _ := s.GetAllPosts(context.Background(), 10, 0)
+		done <- posts
+	}()
+	select {
+	case posts := <-done:
+		if len(posts) != 1 {
+			t.Errorf("expected only the committed post, got %d", len(posts))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read blocked behind an open write transaction")
+	}
+}
+
+func benchmarkSite(b *testing.B) (*site, *user, func()) {
+	p, cleanup := setupFileDB(b)
+	s := newSite(p, "http://localhost:8000", sessions.NewCookieStore([]byte("secret")), "20", "true")
+	u, err := s.CreateUser(context.Background(), "bench", "password")
+	if err != nil {
+		b.Fatalf("CreateUser failed: %v", err)
+	}
+	channels, _ := s.AddChannels(context.Background(), *u, []string{"One", "Two"})
+	for i := 0; i < 500; i++ {
+		body := fmt.Sprintf("benchmark post %d about golang and sqlite and concurrency", i)
+		if _, err := s.AddPost(context.Background(), *u, body, channels[i%2:i%2+1]); err != nil {
+			b.Fatalf("AddPost failed: %v", err)
+		}
+	}
+	return s, u, cleanup
+}
+
+// run with -cpu 1,4,8 to see reads scale with parallelism now that
+// they don't queue up behind a single goroutine
+func BenchmarkSiteParallelReads(b *testing.B) {
+	s, u, cleanup := benchmarkSite(b)
+	defer cleanup()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.GetUser(context.Background(), u.Username); err != nil {
+				b.Error(err)
+			}
+			if _, err := s.GetAllPosts(context.Background(), 20, 0); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSiteParallelSearch(b *testing.B) {
+	s, _, cleanup := benchmarkSite(b)
+	defer cleanup()
+	q := searchQuery{Text: "golang AND sqlite"}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.SearchPosts(context.Background(), q, 20, 0); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// one in ten operations is a write, the rest are page loads
+func BenchmarkSiteParallelMixed(b *testing.B) {
+	s, u, cleanup := benchmarkSite(b)
+	defer cleanup()
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if n.Add(1)%10 == 0 {
+				if _, err := s.AddPost(context.Background(), *u, "another one", nil); err != nil {
+					b.Error(err)
+				}
+				continue
+			}
+			if _, err := s.GetUser(context.Background(), u.Username); err != nil {
+				b.Error(err)
+			}
+			if _, err := s.GetAllPosts(context.Background(), 20, 0); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func TestSiteWriteTimesOut(t *testing.T) {
+	p, cleanup := setupFileDB(t)
+	defer cleanup()
+	s := newSite(p, "http://localhost:8000", sessions.NewCookieStore([]byte("secret")), "10", "true")
+	u, _ := s.CreateUser(context.Background(), "writer", "password")
+	s.OpTimeout = 100 * time.Millisecond
+
+	// tie up the only writer connection so the next write hangs
+	tx, err := p.Database.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	_, err = s.AddPost(context.Background(), *u, "stuck", nil)
+	if !errors.Is(err, errTimeout) {
+		t.Errorf("expected errTimeout, got %v", err)
+	}
+	if errorStatus(err) != 503 {
+		t.Errorf("expected a timeout to map to 503, got %d", errorStatus(err))
+	}
+	tx.Rollback()
+
+	// the actor carries on once the writer is free again
+	if _, err := s.AddPost(context.Background(), *u, "unstuck", nil); err != nil {
+		t.Errorf("AddPost after timeout failed: %v", err)
+	}
+}
+
+func TestSiteCancelledContext(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+	s := newSite(p, "http://localhost:8000", sessions.NewCookieStore([]byte("secret")), "10", "true")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.GetAllPosts(ctx, 10, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from a read, got %v", err)
+	}
+	_, err := s.CreateUser(ctx, "gone", "password")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from a write, got %v", err)
+	}
+	if errors.Is(err, errTimeout) {
+		t.Error("a cancelled request shouldn't look like a timeout")
+	}
+	if _, err := s.GetUser(context.Background(), "gone"); err == nil {
+		t.Error("cancelled CreateUser still created the user")
+	}
+}
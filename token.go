@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// prefix on every token so they're easy to spot in configs and logs
+const tokenPrefix = "finch_"
+
+// last used is only written this often
+const tokenTouchEvery = time.Minute
+
+type apiToken struct {
+	ID       int
+	User     *user
+	Label    string
+	Created  int
+	LastUsed int
+}
+
+func (t apiToken) CreatedTime() time.Time {
+	return time.Unix(int64(t.Created), 0)
+}
+
+// LastUsedTime is the zero time if the token has never been used
+func (t apiToken) LastUsedTime() time.Time {
+	if t.LastUsed == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(t.LastUsed), 0)
+}
+
+// newTokenSecret generates the plaintext token handed to the user.
+// only its hash is ever stored.
+func newTokenSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(b), nil
+}
+
+// hashToken doesn't need to be slow like bcrypt since the
+// secrets are long and random
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSecret(t *testing.T) {
+	a, err := newTokenSecret()
+	if err != nil {
+		t.Fatalf("newTokenSecret failed: %v", err)
+	}
+	b, _ := newTokenSecret()
+	if a == b {
+		t.Error("expected distinct secrets")
+	}
+	if !strings.HasPrefix(a, tokenPrefix) {
+		t.Errorf("expected %q prefix, got %q", tokenPrefix, a)
+	}
+	if hashToken(a) == a || hashToken(a) != hashToken(a) {
+		t.Error("hashToken should be a stable digest")
+	}
+}
+
+func TestPersistenceTokens(t *testing.T) {
+	p, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	u, _ := p.CreateUser(context.Background(), "tokenuser", "password")
+
+	tok, secret, err := p.CreateToken(context.Background(), *u, "laptop")
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	if tok.Label != "laptop" || tok.LastUsed != 0 {
+		t.Errorf("unexpected token %+v", tok)
+	}
+
+	found, err := p.GetToken(context.Background(), secret)
+	if err != nil {
+		t.Fatalf("GetToken failed: %v", err)
+	}
+	if found.User.ID != u.ID || found.ID != tok.ID {
+		t.Errorf("expected token %d for user %d, got %+v", tok.ID, u.ID, found)
+	}
+	if _, err := p.GetToken(context.Background(), secret+"x"); err == nil {
+		t.Error("expected an unknown token to fail")
+	}
+	if err := p.TouchToken(context.Background(), tok.ID, time.Now()); err != nil {
+		t.Fatalf("TouchToken failed: %v", err)
+	}
+
+	if err := p.UpdateTokenLabel(context.Background(), *u, tok.ID, "desktop"); err != nil {
+		t.Fatalf("UpdateTokenLabel failed: %v", err)
+	}
+	tokens, err := p.GetUserTokens(context.Background(), *u)
+	if err != nil {
+		t.Fatalf("GetUserTokens failed: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Label != "desktop" || tokens[0].LastUsed == 0 {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	other, _ := p.CreateUser(context.Background(), "other", "password")
+	if err := p.DeleteToken(context.Background(), *other, tok.ID); err == nil {
+		t.Error("users should not be able to revoke each other's tokens")
+	}
+	if err := p.DeleteToken(context.Background(), *u, tok.ID); err != nil {
+		t.Fatalf("DeleteToken failed: %v", err)
+	}
+	if _, err := p.GetToken(context.Background(), secret); err == nil {
+		t.Error("expected a revoked token to fail")
+	}
+}
+
+func TestUseTokenTouchesOccasionally(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	s.now = clock.Now
+
+	u, _ := s.CreateUser(context.Background(), "chatty", "password")
+	_, secret, _ := s.CreateToken(context.Background(), *u, "bot")
+	lastUsed := func() int {
+		tokens, err := s.GetUserTokens(context.Background(), *u)
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("GetUserTokens: %v %v", tokens, err)
+		}
+		return tokens[0].LastUsed
+	}
+
+	if _, err := s.UseToken(context.Background(), secret); err != nil {
+		t.Fatalf("UseToken failed: %v", err)
+	}
+	first := lastUsed()
+	if first != int(clock.Now().Unix()) {
+		t.Errorf("expected the first use to be recorded, got %d", first)
+	}
+
+	clock.Advance(tokenTouchEvery / 2)
+	s.UseToken(context.Background(), secret)
+	if lastUsed() != first {
+		t.Error("expected a use soon after the last not to write")
+	}
+
+	clock.Advance(tokenTouchEvery)
+	s.UseToken(context.Background(), secret)
+	if lastUsed() != int(clock.Now().Unix()) {
+		t.Error("expected a stale last used time to be updated")
+	}
+}
+
+func TestAPIBearerToken(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	u, _ := s.CreateUser(context.Background(), "botowner", "password")
+	_, secret, err := s.CreateToken(context.Background(), *u, "bot")
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+
+	req := newAPIRequest("POST", "/api/v1/posts/", `{"body": "from a bot"}`)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	rr := serve(handler, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	req = newAPIRequest("POST", "/api/v1/posts/", `{"body": "from a bot"}`)
+	req.Header.Set("Authorization", "Bearer "+tokenPrefix+"bogus")
+	rr = serve(handler, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+}
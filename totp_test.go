@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA1 vectors from RFC 6238, cut down to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got, err := totpCode(secret, totpStep(time.Unix(tc.unix, 0)))
+		if err != nil || got != tc.want {
+			t.Errorf("at %d: expected %s, got %s %v", tc.unix, tc.want, got, err)
+		}
+	}
+	// apps hand out secrets with padding and in lower case too
+	padded := strings.ToLower(base32.StdEncoding.EncodeToString([]byte("12345678901234567890")))
+	if got, _ := totpCode(strings.TrimRight(padded, "="), 1); got != "287082" {
+		t.Errorf("expected a lower case secret to work, got %s", got)
+	}
+}
+
+func TestTOTPMatch(t *testing.T) {
+	secret, _ := newTOTPSecret()
+	now := time.Unix(1700000000, 0)
+	step := totpStep(now)
+	code, _ := totpCode(secret, step)
+
+	if s, ok := totpMatch(secret, code, now, 0); !ok || s != step {
+		t.Errorf("expected the current code to match step %d, got %d %v", step, s, ok)
+	}
+	if _, ok := totpMatch(secret, code[:3]+" "+code[3:], now, 0); !ok {
+		t.Error("expected a code with a space in it to match")
+	}
+	if _, ok := totpMatch(secret, code, now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("expected the previous step's code to still be accepted")
+	}
+	if _, ok := totpMatch(secret, code, now.Add(3*totpPeriod*time.Second), 0); ok {
+		t.Error("expected an old code to be refused")
+	}
+	if _, ok := totpMatch(secret, code, now, step); ok {
+		t.Error("expected a code for an already used step to be refused")
+	}
+	if _, ok := totpMatch(secret, "", now, 0); ok {
+		t.Error("expected an empty code to be refused")
+	}
+
+	uri := totpURI("some one", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Finch:some%20one?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("unexpected otpauth URI %q", uri)
+	}
+}
+
+var recoveryCodeRE = regexp.MustCompile(`<code>([a-z2-7]{4}-[a-z2-7]{4})</code>`)
+
+func TestTwoFactorLogin(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	s.now = clock.Now
+	s.CreateUser(ctx, "careful", "password")
+	cookies := loginCookies(t, handler, "careful", "password")
+
+	// enroll through the settings page
+	resp := formRequest(handler, "/settings/totp/", url.Values{}, cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("starting enrollment: expected 200, got %d", resp.StatusCode)
+	}
+	u, _ := s.GetUser(ctx, "careful")
+	if u.TOTPSecret == "" || u.TOTPEnabled {
+		t.Fatalf("expected a pending secret, got %+v", u)
+	}
+	// the escaper would otherwise swap the link for #ZgotmplZ
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), `href="otpauth://totp/`) {
+		t.Error("expected a link to the otpauth URI")
+	}
+	if resp := formRequest(handler, "/settings/totp/confirm/", url.Values{"code": {"000000"}}, cookies); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected a wrong confirmation code to be refused, got %d", resp.StatusCode)
+	}
+	code, _ := totpCode(u.TOTPSecret, totpStep(clock.Now()))
+	resp = formRequest(handler, "/settings/totp/confirm/", url.Values{"code": {code}}, cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirming: expected 200, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	recovery := recoveryCodeRE.FindAllStringSubmatch(string(body), -1)
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes on the page, got %d", recoveryCodeCount, len(recovery))
+	}
+
+	// the password alone isn't enough any more
+	clock.Advance(time.Minute)
+	login := func() []*http.Cookie {
+		resp := formRequest(handler, "/login/", url.Values{"username": {"careful"}, "password": {"password"}}, nil)
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/login/verify/" {
+			t.Fatalf("expected to be sent to the code step, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+		}
+		return resp.Cookies()
+	}
+	pending := login()
+	if rr := apiRequest(handler, "GET", "/settings/", "", pending); rr.Code != http.StatusFound {
+		t.Errorf("expected to not be logged in before the code, got %d", rr.Code)
+	}
+	if resp := formRequest(handler, "/login/verify/", url.Values{"code": {"123456"}}, pending); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a wrong code to be refused, got %d", resp.StatusCode)
+	}
+	code, _ = totpCode(u.TOTPSecret, totpStep(clock.Now()))
+	resp = formRequest(handler, "/login/verify/", url.Values{"code": {code}}, pending)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the right code to log in, got %d", resp.StatusCode)
+	}
+	if rr := apiRequest(handler, "GET", "/settings/", "", resp.Cookies()); rr.Code != http.StatusOK {
+		t.Errorf("expected to be logged in after the code, got %d", rr.Code)
+	}
+
+	// the same code can't be used twice
+	if resp := formRequest(handler, "/login/verify/", url.Values{"code": {code}}, login()); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a replayed code to be refused, got %d", resp.StatusCode)
+	}
+
+	// recovery codes work once each, typed however
+	first := strings.ToUpper(strings.ReplaceAll(recovery[0][1], "-", ""))
+	if resp := formRequest(handler, "/login/verify/", url.Values{"code": {first}}, login()); resp.StatusCode != http.StatusFound {
+		t.Errorf("expected a recovery code to log in, got %d", resp.StatusCode)
+	}
+	if resp := formRequest(handler, "/login/verify/", url.Values{"code": {recovery[0][1]}}, login()); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a used recovery code to be refused, got %d", resp.StatusCode)
+	}
+	if n, _ := s.CountRecoveryCodes(ctx, *u); n != recoveryCodeCount-1 {
+		t.Errorf("expected %d recovery codes left, got %d", recoveryCodeCount-1, n)
+	}
+
+	// the code step doesn't wait around forever
+	pending = login()
+	clock.Advance(pendingTimeout + time.Second)
+	code, _ = totpCode(u.TOTPSecret, totpStep(clock.Now()))
+	if resp := formRequest(handler, "/login/verify/", url.Values{"code": {code}}, pending); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/login/" {
+		t.Errorf("expected a stale login to start over, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestTwoFactorCodesCountTowardsLockout(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	s.now = clock.Now
+	u, _ := s.CreateUser(ctx, "guarded", "password")
+	s.StartTOTP(ctx, *u)
+	u, _ = s.GetUser(ctx, "guarded")
+	code, _ := totpCode(u.TOTPSecret, totpStep(clock.Now()))
+	if _, err := s.ConfirmTOTP(ctx, *u, code); err != nil {
+		t.Fatalf("ConfirmTOTP failed: %v", err)
+	}
+
+	// knowing the password mustn't let someone keep guessing codes
+	for i := 0; i < lockoutThreshold; i++ {
+		clock.Advance(loginBackoffMax)
+		if _, err := s.Login(ctx, "guarded", "password", "10.0.0.1"); err != nil {
+			t.Fatalf("attempt %d: expected the password to be accepted, got %v", i+1, err)
+		}
+		if _, err := s.VerifySecondFactor(ctx, "guarded", "000000", "10.0.0.1"); !errors.Is(err, errBadCode) {
+			t.Fatalf("attempt %d: expected errBadCode, got %v", i+1, err)
+		}
+	}
+	clock.Advance(5 * time.Minute)
+	code, _ = totpCode(u.TOTPSecret, totpStep(clock.Now()))
+	if _, err := s.VerifySecondFactor(ctx, "guarded", code, "10.0.0.2"); !errors.Is(err, errTooManyAttempts) {
+		t.Errorf("expected the account to be locked, got %v", err)
+	}
+	attempts, _ := s.GetLoginAttempts(ctx, "guarded", 20)
+	if len(attempts) == 0 || attempts[len(attempts)-1].Reason != loginBadCode {
+		t.Errorf("expected bad codes in the audit log, got %v", attempts)
+	}
+
+	u, _ = s.GetUser(ctx, "guarded")
+	if err := s.DisableTOTP(ctx, *u, "wrong"); !errors.Is(err, errValidation) {
+		t.Errorf("expected turning it off to need the password, got %v", err)
+	}
+	if err := s.DisableTOTP(ctx, *u, "password"); err != nil {
+		t.Fatalf("DisableTOTP failed: %v", err)
+	}
+	if u, _ = s.GetUser(ctx, "guarded"); u.TOTPEnabled || u.TOTPSecret != "" {
+		t.Error("expected two factor auth to be off")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// between the password and the code, the session holds who is
+// logging in under pendingUser rather than "user", so nothing
+// treats them as logged in yet
+const (
+	pendingUser    = "pending_user"
+	pendingAt      = "pending_at"
+	pendingTimeout = 5 * time.Minute
+)
+
+func totpStartHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, _ *settingsResponse) error {
+		return s.StartTOTP(r.Context(), u)
+	}, "add the key to your authenticator app and enter the code it shows to finish")
+}
+
+func totpConfirmHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, sr *settingsResponse) error {
+		codes, err := s.ConfirmTOTP(r.Context(), u, r.FormValue("code"))
+		sr.RecoveryCodes = codes
+		return err
+	}, "two factor authentication is on")
+}
+
+func totpDisableHandler(s *site) http.Handler {
+	return accountFormHandler(s, func(r *http.Request, u user, _ *settingsResponse) error {
+		return s.DisableTOTP(r.Context(), u, r.FormValue("password"))
+	}, "two factor authentication is off")
+}
+
+// pendingLogin is the user who got their password right and still
+// needs to give a code, if they did so recently enough
+func pendingLogin(s *site, r *http.Request) (string, bool) {
+	sess, _ := s.Store.Get(r, "finch")
+	username, _ := sess.Values[pendingUser].(string)
+	at, _ := sess.Values[pendingAt].(int64)
+	if username == "" || s.now().Sub(time.Unix(at, 0)) > pendingTimeout {
+		return "", false
+	}
+	return username, true
+}
+
+func loginVerifyFormHandler(s *site) http.Handler {
+	tmpl := getTemplate("login_verify.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if _, ok := pendingLogin(s, r); !ok {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			lr := loginResponse{}
+			ctx.PopulateResponse(&lr)
+			render(w, ctx, tmpl, http.StatusOK, lr)
+		})
+}
+
+func loginVerifyHandler(s *site) http.Handler {
+	tmpl := getTemplate("login_verify.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			username, ok := pendingLogin(s, r)
+			if !ok {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			user, err := s.VerifySecondFactor(r.Context(), username, r.FormValue("code"), s.clientIP(r))
+			if errors.Is(err, errBadCode) || errors.Is(err, errTooManyAttempts) || errors.Is(err, errAccountDisabled) {
+				lr := loginResponse{Error: err.Error()}
+				ctx.PopulateResponse(&lr)
+				render(w, ctx, tmpl, loginStatus(err), lr)
+				return
+			}
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+
+			if err := logIn(s, w, r, user.Username); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusFound)
+		})
+}
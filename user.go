@@ -1,11 +1,37 @@
 package main
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"html/template"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type user struct {
 	ID       int
 	Username string
 	Password []byte
+	// unix time a lockout after too many failed logins ends
+	LockedUntil int
+	DisplayName string
+	Bio         string
+	// two factor auth. the secret is set during enrollment, before
+	// it's enabled.
+	TOTPSecret   string
+	TOTPEnabled  bool
+	TOTPLastStep int64
+	// username of whoever invited them, if anyone did
+	InvitedBy string
+	IsAdmin   bool
+	Disabled  bool
+}
+
+// Name is what to call the user: their display name if they've set
+// one, otherwise their username
+func (u user) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
 }
 
 // SetPassword takes a plaintext password and hashes it with bcrypt
@@ -24,3 +50,17 @@ func (u user) CheckPassword(password string) bool {
 	}
 	return true
 }
+
+// TOTPURI is the otpauth link for setting up an authenticator app
+// with the user's pending or enabled secret. it's marked safe since
+// html/template only lets http, https and mailto links through, and
+// every part of it is escaped by totpURI.
+func (u user) TOTPURI() template.URL {
+	return template.URL(totpURI(u.Username, u.TOTPSecret))
+}
+
+// CanDelete is whether the user can delete something owned by
+// owner. admins can delete anything, for moderation.
+func (u user) CanDelete(owner *user) bool {
+	return u.IsAdmin || u.ID == owner.ID
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	minUsername = 2
+	// users.username is varchar(32)
+	maxUsername = 32
+	minPassword = 8
+	// bcrypt only looks at the first 72 bytes, and refuses
+	// anything longer
+	maxPassword = 72
+)
+
+// reservedUsernames would be confusing or dangerous as a /u/ page,
+// or might be wanted for the site itself later
+var reservedUsernames = map[string]bool{
+	"about": true, "admin": true, "administrator": true, "api": true,
+	"anonymous": true, "feed": true, "finch": true, "help": true,
+	"healthz": true, "login": true, "logout": true, "media": true,
+	"moderator": true, "nobody": true, "post": true, "register": true,
+	"reset": true, "root": true, "search": true, "settings": true,
+	"static": true, "support": true, "system": true, "u": true,
+	"www": true,
+}
+
+// commonPasswords are the top of every leaked password list, which
+// is the first thing anyone guessing will try
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password12": true, "password123": true,
+	"passw0rd": true, "12345678": true, "123456789": true, "1234567890": true,
+	"qwertyuiop": true, "qwerty123": true, "11111111": true, "iloveyou": true,
+	"sunshine": true, "princess": true, "football": true, "baseball": true,
+	"welcome1": true, "letmein1": true, "trustno1": true, "changeme": true,
+	"abc12345": true, "abcd1234": true, "superman": true, "starwars": true,
+}
+
+// checkUsername says what's wrong with a username, or "" if it's
+// fine. names are limited to what's safe in a /u/{username}/ URL.
+func checkUsername(username string) string {
+	if len(username) < minUsername || len(username) > maxUsername {
+		return fmt.Sprintf("username must be %d to %d characters", minUsername, maxUsername)
+	}
+	for i, c := range username {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case (c == '_' || c == '-') && i > 0:
+		default:
+			return "username can only have letters, numbers, _ and -, and must start with a letter or number"
+		}
+	}
+	if reservedUsernames[strings.ToLower(username)] {
+		return "that username is reserved"
+	}
+	return ""
+}
+
+// checkPassword says what's wrong with a new password, or "" if
+// it's fine
+func checkPassword(password, username string) string {
+	if len(password) < minPassword {
+		return fmt.Sprintf("password must be at least %d characters", minPassword)
+	}
+	if len(password) > maxPassword {
+		return fmt.Sprintf("password can be at most %d bytes", maxPassword)
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return "that password is too common"
+	}
+	if strings.Count(password, password[:1]) == len(password) {
+		return "password can't be one character repeated"
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return "password can't contain your username"
+	}
+	return ""
+}
+
+// invalidFields is a validation error for a form, with a message
+// for each field that has a problem
+func invalidFields(fields map[string]string) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fields[name]
+	}
+	return &siteError{Kind: errValidation, Msg: strings.Join(msgs, "; "), Fields: fields}
+}
+
+// formErrors collects problems with a form's fields
+type formErrors map[string]string
+
+func (f formErrors) check(field, msg string) {
+	if msg != "" && f[field] == "" {
+		f[field] = msg
+	}
+}
+
+func (f formErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+	return invalidFields(f)
+}
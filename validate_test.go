@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckUsername(t *testing.T) {
+	good := []string{"ab", "bob", "Alice", "user_1", "x-y", "a2345678901234567890123456789012"}
+	for _, name := range good {
+		if msg := checkUsername(name); msg != "" {
+			t.Errorf("%q: expected to be allowed, got %q", name, msg)
+		}
+	}
+	bad := []string{
+		"", "a", "a23456789012345678901234567890123",
+		"with space", "slash/y", "dot.dot", "..", "_leading", "-leading",
+		"émile", "a?b", "a%2F",
+		"api", "admin", "Media", "SETTINGS", "u",
+	}
+	for _, name := range bad {
+		if msg := checkUsername(name); msg == "" {
+			t.Errorf("%q: expected to be refused", name)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	for _, tc := range []struct {
+		password string
+		ok       bool
+	}{
+		{"tall ship 42", true},
+		{"correct horse battery staple", true},
+		{"short", false},
+		{"password", false},
+		{"PASSWORD123", false},
+		{"aaaaaaaaaaaa", false},
+		{"my name is someone", false},
+		{strings.Repeat("x", 70) + "yz", true},
+		{strings.Repeat("x", 72) + "y", false},
+	} {
+		if msg := checkPassword(tc.password, "someone"); (msg == "") != tc.ok {
+			t.Errorf("%q: expected ok=%v, got %q", tc.password, tc.ok, msg)
+		}
+	}
+}
+
+func TestCreateUserChecksUsername(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	_, err := s.CreateUser(context.Background(), "no/slashes", "tall ship 42")
+	if !errors.Is(err, errValidation) || fieldErrors(err)["username"] == "" {
+		t.Errorf("expected a username field error, got %v", err)
+	}
+}
+
+func TestUsernamesIgnoreCase(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	if _, err := s.CreateUser(context.Background(), "Alice", "tall ship 42"); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	for _, name := range []string{"alice", "ALICE", "aLiCe"} {
+		if _, err := s.CreateUser(context.Background(), name, "tall ship 42"); !errors.Is(err, errConflict) {
+			t.Errorf("%s: expected a conflict with Alice, got %v", name, err)
+		}
+	}
+	if n := countRows(t, s.p, "users"); n != 1 {
+		t.Errorf("expected only Alice, found %d users", n)
+	}
+}
+
+func TestRegisterFieldErrors(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "taken", "password")
+
+	for _, tc := range []struct {
+		form  url.Values
+		field string
+		want  string
+	}{
+		{url.Values{"username": {"has space"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, "username", "username can only have"},
+		{url.Values{"username": {"admin"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, "username", "reserved"},
+		{url.Values{"username": {"newbie"}, "password": {"short"}, "pass2": {"short"}}, "password", "at least 8"},
+		{url.Values{"username": {"newbie"}, "password": {"tall ship 42"}, "pass2": {"tall ship 43"}}, "confirm", "don&#39;t match"},
+		{url.Values{"username": {"taken"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, "username", "taken"},
+		{url.Values{"username": {"Taken"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, "username", "taken"},
+	} {
+		resp := formRequest(handler, "/register/", tc.form, nil)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusFound {
+			t.Errorf("%v: expected to be refused", tc.form)
+			continue
+		}
+		if !strings.Contains(string(body), tc.want) || !strings.Contains(string(body), `has-error`) {
+			t.Errorf("%v: expected the form back with %q by the %s field", tc.form, tc.want, tc.field)
+		}
+		if !strings.Contains(string(body), `value="`+tc.form.Get("username")+`"`) {
+			t.Errorf("%v: expected the username to be filled back in", tc.form)
+		}
+	}
+	if _, err := s.GetUser(context.Background(), "newbie"); !errors.Is(err, errNotFound) {
+		t.Error("a refused registration made an account")
+	}
+
+	resp := formRequest(handler, "/register/", url.Values{"username": {"newbie"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected a good registration to redirect, got %d", resp.StatusCode)
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
 
 	"github.com/gorilla/feeds"
 	"github.com/russross/blackfriday"
@@ -15,7 +17,9 @@ import (
 
 type siteResponse struct {
 	Username          string
+	IsAdmin           bool
 	AllowRegistration bool
+	CSRFToken         string
 }
 
 func (s *siteResponse) SetUsername(username string) {
@@ -26,14 +30,24 @@ func (s siteResponse) GetUsername() string {
 	return s.Username
 }
 
+func (s *siteResponse) SetIsAdmin(admin bool) {
+	s.IsAdmin = admin
+}
+
 func (s *siteResponse) SetAllowRegistration(allowReg bool) {
 	s.AllowRegistration = allowReg
 }
 
+func (s *siteResponse) SetCSRFToken(token string) {
+	s.CSRFToken = token
+}
+
 type sr interface {
 	SetUsername(string)
 	GetUsername() string
+	SetIsAdmin(bool)
 	SetAllowRegistration(bool)
+	SetCSRFToken(string)
 }
 
 func faviconHandler(w http.ResponseWriter, r *http.Request) {
@@ -43,24 +57,159 @@ func faviconHandler(w http.ResponseWriter, r *http.Request) {
 type siteContext struct {
 	Site *site
 	User *user
+	// set when the request authenticated with an API token
+	// rather than the session cookie
+	TokenAuth bool
+	// for the hidden field in forms
+	CSRFToken string
+	// errors go back as JSON rather than a page
+	JSON bool
+}
+
+// bearerToken pulls an API token out of the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// wantsJSON reports whether the Accept header prefers JSON to HTML.
+// browsers send text/html or */*, so a tie goes to the page.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	jsonQ := acceptQuality(accept, "application", "json")
+	return jsonQ > 0 && jsonQ > acceptQuality(accept, "text", "html")
+}
+
+// acceptQuality is the q value the Accept header gives a media
+// type, taken from the most specific range that matches it
+func acceptQuality(accept, typ, subtype string) float64 {
+	best, q := -1, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		t, st, _ := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		specificity := 0
+		switch {
+		case t == typ && st == subtype:
+			specificity = 2
+		case t == typ && st == "*":
+			specificity = 1
+		case t == "*" && st == "*":
+			specificity = 0
+		default:
+			continue
+		}
+		if specificity <= best {
+			continue
+		}
+		best, q = specificity, 1.0
+		for _, p := range params[1:] {
+			k, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(val, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return q
 }
 
 func (c *siteContext) Populate(r *http.Request) {
+	c.JSON = wantsJSON(r)
+	if secret, ok := bearerToken(r); ok {
+		// a bad token doesn't fall back to the session
+		c.TokenAuth = true
+		user, err := c.Site.UseToken(r.Context(), secret)
+		if err == nil {
+			c.User = user
+		}
+		return
+	}
 	sess, _ := c.Site.Store.Get(r, "finch")
+	c.CSRFToken, _ = sess.Values[csrfSession].(string)
 	username, found := sess.Values["user"]
 	if found && username != "" {
-		user, err := c.Site.GetUser(username.(string))
-		if err == nil {
+		// a disabled account is logged out wherever it's logged in
+		user, err := c.Site.GetUser(r.Context(), username.(string))
+		if err == nil && !user.Disabled {
 			c.User = user
 		}
 	}
 }
 
+type errorResponse struct {
+	Status  int
+	Message string
+	siteResponse
+}
+
+// errorPage is the one page every handler uses to report a failure.
+// clients that asked for JSON get the same body the API sends.
+func errorPage(w http.ResponseWriter, ctx siteContext, status int, msg string) {
+	if ctx.JSON {
+		writeJSONError(w, status, msg)
+		return
+	}
+	tmpl := ctx.Site.errorTmpl
+	if tmpl == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	er := errorResponse{Status: status, Message: msg}
+	ctx.PopulateResponse(&er)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, er); err != nil {
+		// nothing nicer left to show
+		log.Printf("rendering %s: %v", tmpl.name, err)
+		http.Error(w, msg, status)
+		return
+	}
+	writePage(w, status, &buf)
+}
+
+// render shows a page. it's rendered into a buffer first so that a
+// template failure becomes a 500 error page instead of half a page
+// that went out as a 200.
+func render(w http.ResponseWriter, ctx siteContext, tmpl *page, status int, data interface{}) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		renderError(w, ctx, fmt.Errorf("rendering %s: %w", tmpl.name, err))
+		return
+	}
+	writePage(w, status, &buf)
+}
+
+func writePage(w http.ResponseWriter, status int, buf *bytes.Buffer) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// renderError shows an error that came back from the site. the
+// details of internal errors are logged, not shown.
+func renderError(w http.ResponseWriter, ctx siteContext, err error) {
+	status := errorStatus(err)
+	if status >= 500 {
+		log.Println(err)
+	}
+	errorPage(w, ctx, status, errorMessage(err))
+}
+
 func (c siteContext) PopulateResponse(sr sr) {
 	if c.User != nil {
 		sr.SetUsername(c.User.Username)
+		sr.SetIsAdmin(c.User.IsAdmin)
 	}
-	sr.SetAllowRegistration(c.Site.AllowRegistration)
+	sr.SetAllowRegistration(c.Site.RegistrationOpen())
+	sr.SetCSRFToken(c.CSRFToken)
 }
 
 type paginationResponse struct {
@@ -71,6 +220,16 @@ type paginationResponse struct {
 	HasPrevPage bool
 }
 
+// notFoundHandler catches every path nothing else matched
+func notFoundHandler(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			errorPage(w, ctx, http.StatusNotFound, "page not found")
+		})
+}
+
 func indexHandler(s *site) http.Handler {
 	type indexResponse struct {
 		Posts []*post
@@ -91,7 +250,7 @@ func indexHandler(s *site) http.Handler {
 			if err != nil {
 				page = 0
 			}
-			posts, err := s.GetAllPosts(s.ItemsPerPage, page*s.ItemsPerPage)
+			posts, err := s.GetAllPosts(r.Context(), s.ItemsPerPage, page*s.ItemsPerPage)
 			ir.Posts = posts
 			ir.Page = page + 1
 			ir.PrevPage = page - 1
@@ -107,11 +266,10 @@ func indexHandler(s *site) http.Handler {
 				ir.HasNextPage = true
 			}
 			if err != nil {
-				log.Println(err)
-				fmt.Fprintf(w, "error getting posts")
+				renderError(w, ctx, err)
 				return
 			}
-			tmpl.Execute(w, ir)
+			render(w, ctx, tmpl, http.StatusOK, ir)
 		})
 }
 
@@ -119,7 +277,9 @@ func searchHandler(s *site) http.Handler {
 	type searchResponse struct {
 		Posts []*post
 		Q     string
+		Error string
 		siteResponse
+		paginationResponse
 	}
 	tmpl := getTemplate("search.html")
 
@@ -130,13 +290,39 @@ func searchHandler(s *site) http.Handler {
 			q := r.FormValue("q")
 			sr := searchResponse{Q: q}
 			ctx.PopulateResponse(&sr)
-			posts, err := s.SearchPosts(q, s.ItemsPerPage, 0)
+			query, err := parseSearchQuery(q)
 			if err != nil {
-				http.Error(w, "search broke", 500)
+				sr.Error = strings.TrimPrefix(err.Error(), errInvalidSearch.Error()+": ")
+				render(w, ctx, tmpl, http.StatusBadRequest, sr)
+				return
+			}
+			if query.Empty() {
+				render(w, ctx, tmpl, http.StatusOK, sr)
+				return
+			}
+			spage := r.URL.Query().Get("page")
+			page, err := strconv.Atoi(spage)
+			if err != nil || page < 0 {
+				page = 0
+			}
+			posts, err := s.SearchPosts(r.Context(), query, s.ItemsPerPage, page*s.ItemsPerPage)
+			if errors.Is(err, errInvalidSearch) {
+				sr.Error = "Couldn't understand that search. Check for unbalanced quotes, parentheses or a trailing AND/OR/NOT."
+				render(w, ctx, tmpl, http.StatusBadRequest, sr)
+				return
+			}
+			if err != nil {
+				renderError(w, ctx, err)
 				return
 			}
 			sr.Posts = posts
-			tmpl.Execute(w, sr)
+			sr.Page = page + 1
+			sr.PrevPage = page - 1
+			sr.NextPage = page + 1
+			sr.HasPrevPage = sr.PrevPage > -1
+			// same caveat as the other listings
+			sr.HasNextPage = len(posts) == s.ItemsPerPage
+			render(w, ctx, tmpl, http.StatusOK, sr)
 		})
 }
 
@@ -168,20 +354,53 @@ func postFormHandler(s *site) http.Handler {
 			}
 			ar := addResponse{}
 			ctx.PopulateResponse(&ar)
-			c, err := s.GetUserChannels(*ctx.User)
+			c, err := s.GetUserChannels(r.Context(), *ctx.User)
 			if err != nil {
-				http.Error(w, "couldn't get channels", 500)
+				renderError(w, ctx, err)
 				return
 			}
 			ar.Channels = c
 			url := r.FormValue("url")
 			title := r.FormValue("title")
 			ar.Body = bodyFromFields(url, title)
-			tmpl.Execute(w, ar)
+			render(w, ctx, tmpl, http.StatusOK, ar)
 			return
 		})
 }
 
+// channelsFromForm collects the existing channels selected in the
+// post form along with any new ones named there. the new ones
+// aren't created until the post is saved.
+func channelsFromForm(s *site, u user, r *http.Request) ([]*channel, error) {
+	var channels []*channel
+	for _, name := range []string{r.FormValue("new_channel0"), r.FormValue("new_channel1"), r.FormValue("new_channel2")} {
+		if name != "" {
+			channels = append(channels, newChannel(u, name))
+		}
+	}
+
+	// and any existing selected channels
+	for k := range r.Form {
+		if strings.HasPrefix(k, "channel_") {
+			id, err := strconv.Atoi(strings.TrimPrefix(k, "channel_"))
+			if err != nil {
+				// couldn't parse it for some reason
+				continue
+			}
+			c, err := s.GetChannelByID(r.Context(), id)
+			if err != nil {
+				continue
+			}
+			if c.User.ID != u.ID {
+				// can't post into someone else's channel
+				continue
+			}
+			channels = append(channels, c)
+		}
+	}
+	return channels, nil
+}
+
 func postHandler(s *site) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -192,35 +411,15 @@ func postHandler(s *site) http.Handler {
 				return
 			}
 			body := r.FormValue("body")
-			nchan := make([]string, 3)
-			nchan[0], nchan[1], nchan[2] = r.FormValue("new_channel0"), r.FormValue("new_channel1"), r.FormValue("new_channel2")
-			channels, err := s.AddChannels(*ctx.User, nchan)
-			if err != nil {
-				log.Fatal(err)
-				fmt.Fprintf(w, "error making channels")
-				return
-			}
-
-			// and any existing selected channels
-			for k := range r.Form {
-				if strings.HasPrefix(k, "channel_") {
-					id, err := strconv.Atoi(strings.TrimPrefix(k, "channel_"))
-					if err != nil {
-						// couldn't parse it for some reason
-						continue
-					}
-					c, err := s.GetChannelByID(id)
-					if err != nil {
-						continue
-					}
-					channels = append(channels, c)
-				}
+			channels, err := channelsFromForm(s, *ctx.User, r)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
 			}
 
-			_, err = s.AddPost(*ctx.User, body, channels)
+			_, err = s.AddPost(r.Context(), *ctx.User, body, channels)
 			if err != nil {
-				log.Fatal(err)
-				fmt.Fprintf(w, "could not add post")
+				renderError(w, ctx, err)
 				return
 			}
 			http.Redirect(w, r, "/", http.StatusFound)
@@ -229,7 +428,10 @@ func postHandler(s *site) http.Handler {
 
 func individualPostHandler(s *site) http.Handler {
 	type postPageResponse struct {
-		Post *post
+		Post     *post
+		Edited   bool
+		LastEdit *revision
+		History  []revisionDiff
 		siteResponse
 	}
 	tmpl := getTemplate("post.html")
@@ -238,26 +440,123 @@ func individualPostHandler(s *site) http.Handler {
 			username := r.PathValue("username")
 			puuid := r.PathValue("puuid")
 			ctx := siteContext{Site: s}
-			_, err := s.GetUser(username)
+			ctx.Populate(r)
+			_, err := s.GetVisibleUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			p, err := s.GetPostByUUID(puuid)
+			p, err := s.GetVisiblePost(r.Context(), puuid)
 			if err != nil {
-				http.Error(w, "post not found", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Populate(r)
 			pr := postPageResponse{}
 			ctx.PopulateResponse(&pr)
 			pr.Post = p
-			channels, err := ctx.Site.GetPostChannels(p)
+			channels, err := ctx.Site.GetPostChannels(r.Context(), p)
 			if err != nil {
-				http.Error(w, "error retrieving channels", 500)
+				renderError(w, ctx, err)
+				return
 			}
 			pr.Post.Channels = channels
-			tmpl.Execute(w, pr)
+			revisions, err := ctx.Site.GetPostRevisions(r.Context(), p)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			if len(revisions) > 0 {
+				pr.Edited = true
+				pr.LastEdit = revisions[len(revisions)-1]
+				pr.History = historyFor(s.diffs, p, revisions)
+			}
+			render(w, ctx, tmpl, http.StatusOK, pr)
+		})
+}
+
+type editChannel struct {
+	*channel
+	Checked bool
+}
+
+func editPostFormHandler(s *site) http.Handler {
+	type editResponse struct {
+		Post     *post
+		Channels []editChannel
+		siteResponse
+	}
+	tmpl := getTemplate("edit.html")
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			puuid := r.PathValue("puuid")
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			p, err := s.GetPostByUUID(r.Context(), puuid)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			if ctx.User.ID != p.User.ID {
+				errorPage(w, ctx, http.StatusForbidden, "you can only edit your own posts")
+				return
+			}
+			current, err := s.GetPostChannels(r.Context(), p)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			checked := make(map[int]bool)
+			for _, c := range current {
+				checked[c.ID] = true
+			}
+			all, err := s.GetUserChannels(r.Context(), *ctx.User)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			er := editResponse{Post: p}
+			ctx.PopulateResponse(&er)
+			for _, c := range all {
+				er.Channels = append(er.Channels, editChannel{channel: c, Checked: checked[c.ID]})
+			}
+			render(w, ctx, tmpl, http.StatusOK, er)
+		})
+}
+
+func editPostHandler(s *site) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			puuid := r.PathValue("puuid")
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			if ctx.User == nil {
+				http.Redirect(w, r, "/login/", http.StatusFound)
+				return
+			}
+			p, err := s.GetPostByUUID(r.Context(), puuid)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			if ctx.User.ID != p.User.ID {
+				errorPage(w, ctx, http.StatusForbidden, "you can only edit your own posts")
+				return
+			}
+			channels, err := channelsFromForm(s, *ctx.User, r)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			p, err = s.UpdatePost(r.Context(), p, r.FormValue("body"), channels)
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
+			http.Redirect(w, r, p.URL(), http.StatusFound)
 		})
 }
 
@@ -275,12 +574,12 @@ func userIndex(s *site) http.Handler {
 
 			username := r.PathValue("username")
 			ctx := siteContext{Site: s}
-			u, err := s.GetUser(username)
+			ctx.Populate(r)
+			u, err := s.GetVisibleUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Populate(r)
 			ir := userIndexResponse{User: u}
 			ctx.PopulateResponse(&ir)
 
@@ -289,15 +588,15 @@ func userIndex(s *site) http.Handler {
 			if err != nil {
 				page = 0
 			}
-			allPosts, err := ctx.Site.GetAllUserPosts(u, ctx.Site.ItemsPerPage, page*ctx.Site.ItemsPerPage)
+			allPosts, err := ctx.Site.GetAllUserPosts(r.Context(), u, ctx.Site.ItemsPerPage, page*ctx.Site.ItemsPerPage)
 			if err != nil {
-				http.Error(w, "couldn't retrieve posts", 500)
+				renderError(w, ctx, err)
 				return
 			}
 			ir.Posts = allPosts
-			c, err := ctx.Site.GetUserChannels(*u)
+			c, err := ctx.Site.GetUserChannels(r.Context(), *u)
 			if err != nil {
-				http.Error(w, "couldn't get channels", 500)
+				renderError(w, ctx, err)
 				return
 			}
 			ir.Channels = c
@@ -316,7 +615,7 @@ func userIndex(s *site) http.Handler {
 				ir.HasNextPage = true
 			}
 
-			tmpl.Execute(w, ir)
+			render(w, ctx, tmpl, http.StatusOK, ir)
 		})
 }
 
@@ -325,21 +624,21 @@ func userFeed(s *site) http.Handler {
 		func(w http.ResponseWriter, r *http.Request) {
 			username := r.PathValue("username")
 			ctx := siteContext{Site: s}
-			u, err := s.GetUser(username)
+			ctx.Populate(r)
+			u, err := s.GetVisibleUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Populate(r)
 			base := ctx.Site.BaseURL
 
-			allPosts, err := ctx.Site.GetAllUserPosts(u, ctx.Site.ItemsPerPage, 0)
+			allPosts, err := ctx.Site.GetAllUserPosts(r.Context(), u, ctx.Site.ItemsPerPage, 0)
 			if err != nil {
-				http.Error(w, "couldn't retrieve posts", 500)
+				renderError(w, ctx, err)
 				return
 			}
 			if len(allPosts) == 0 {
-				http.Error(w, "no posts", 404)
+				errorPage(w, ctx, http.StatusNotFound, "no posts")
 				return
 			}
 			latest := allPosts[0]
@@ -359,12 +658,16 @@ func userFeed(s *site) http.Handler {
 					&feeds.Item{
 						Title:       u.Username + ": " + p.Time().UTC().Format(layout),
 						Link:        &feeds.Link{Href: base + p.URL()},
-						Description: string(blackfriday.MarkdownBasic([]byte(p.Body))),
+						Description: sanitizeHTML(blackfriday.MarkdownBasic([]byte(p.Body))),
 						Author:      &feeds.Author{Name: u.Username, Email: u.Username},
 						Created:     p.Time(),
 					})
 			}
-			atom, _ := feed.ToAtom()
+			atom, err := feed.ToAtom()
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
 			w.Header().Set("Content-Type", "application/atom+xml")
 			fmt.Fprint(w, atom)
 		})
@@ -376,26 +679,29 @@ func channelDelete(s *site) http.Handler {
 			username := r.PathValue("username")
 			slug := r.PathValue("slug")
 			ctx := siteContext{Site: s}
-			u, err := s.GetUser(username)
+			ctx.Populate(r)
+			u, err := s.GetUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			c, err := s.GetChannel(*u, slug)
+			c, err := s.GetChannel(r.Context(), *u, slug)
 			if err != nil {
-				http.Error(w, "channel not found", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Populate(r)
 			if ctx.User == nil {
 				http.Redirect(w, r, "/login/", http.StatusFound)
 				return
 			}
-			if ctx.User.ID != c.User.ID {
-				http.Error(w, "you can only delete your own channels", 403)
+			if !ctx.User.CanDelete(c.User) {
+				errorPage(w, ctx, http.StatusForbidden, "you can only delete your own channels")
+				return
+			}
+			if err := ctx.Site.DeleteChannel(r.Context(), c); err != nil {
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Site.DeleteChannel(c)
 			http.Redirect(w, r, "/", http.StatusFound)
 		})
 }
@@ -406,26 +712,29 @@ func postDelete(s *site) http.Handler {
 			username := r.PathValue("username")
 			puuid := r.PathValue("puuid")
 			ctx := siteContext{Site: s}
-			_, err := s.GetUser(username)
+			ctx.Populate(r)
+			_, err := s.GetUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			p, err := s.GetPostByUUID(puuid)
+			p, err := s.GetPostByUUID(r.Context(), puuid)
 			if err != nil {
-				http.Error(w, "post not found", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Populate(r)
 			if ctx.User == nil {
 				http.Redirect(w, r, "/login/", http.StatusFound)
 				return
 			}
-			if ctx.User.ID != p.User.ID {
-				http.Error(w, "you can only delete your own posts", 403)
+			if !ctx.User.CanDelete(p.User) {
+				errorPage(w, ctx, http.StatusForbidden, "you can only delete your own posts")
+				return
+			}
+			if err := ctx.Site.DeletePost(r.Context(), p); err != nil {
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Site.DeletePost(p)
 			http.Redirect(w, r, "/", http.StatusFound)
 		})
 }
@@ -436,25 +745,26 @@ func channelFeed(s *site) http.Handler {
 			username := r.PathValue("username")
 			slug := r.PathValue("slug")
 			ctx := siteContext{Site: s}
-			u, err := s.GetUser(username)
+			ctx.Populate(r)
+			u, err := s.GetVisibleUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			c, err := s.GetChannel(*u, slug)
+			c, err := s.GetChannel(r.Context(), *u, slug)
 			if err != nil {
-				http.Error(w, "channel not found", 404)
+				renderError(w, ctx, err)
 				return
 			}
 			base := ctx.Site.BaseURL
 
-			allPosts, err := ctx.Site.GetAllPostsInChannel(*c, ctx.Site.ItemsPerPage, 0)
+			allPosts, err := ctx.Site.GetAllPostsInChannel(r.Context(), *c, ctx.Site.ItemsPerPage, 0)
 			if err != nil {
-				http.Error(w, "couldn't retrieve posts", 500)
+				renderError(w, ctx, err)
 				return
 			}
 			if len(allPosts) == 0 {
-				http.Error(w, "no posts", 404)
+				errorPage(w, ctx, http.StatusNotFound, "no posts")
 				return
 			}
 			latest := allPosts[0]
@@ -474,12 +784,16 @@ func channelFeed(s *site) http.Handler {
 					&feeds.Item{
 						Title:       u.Username + ": " + p.Time().UTC().Format(layout),
 						Link:        &feeds.Link{Href: base + p.URL()},
-						Description: string(blackfriday.MarkdownBasic([]byte(p.Body))),
+						Description: sanitizeHTML(blackfriday.MarkdownBasic([]byte(p.Body))),
 						Author:      &feeds.Author{Name: u.Username, Email: u.Username},
 						Created:     p.Time(),
 					})
 			}
-			atom, _ := feed.ToAtom()
+			atom, err := feed.ToAtom()
+			if err != nil {
+				renderError(w, ctx, err)
+				return
+			}
 			w.Header().Set("Content-Type", "application/atom+xml")
 			fmt.Fprint(w, atom)
 		})
@@ -498,17 +812,17 @@ func channelIndex(s *site) http.Handler {
 			username := r.PathValue("username")
 			slug := r.PathValue("slug")
 			ctx := siteContext{Site: s}
-			u, err := s.GetUser(username)
+			ctx.Populate(r)
+			u, err := s.GetVisibleUser(r.Context(), username)
 			if err != nil {
-				http.Error(w, "user doesn't exist", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			c, err := s.GetChannel(*u, slug)
+			c, err := s.GetChannel(r.Context(), *u, slug)
 			if err != nil {
-				http.Error(w, "channel not found", 404)
+				renderError(w, ctx, err)
 				return
 			}
-			ctx.Populate(r)
 			ir := channelIndexResponse{Channel: c}
 			ctx.PopulateResponse(&ir)
 
@@ -517,9 +831,9 @@ func channelIndex(s *site) http.Handler {
 			if err != nil {
 				page = 0
 			}
-			allPosts, err := ctx.Site.GetAllPostsInChannel(*c, ctx.Site.ItemsPerPage, page*ctx.Site.ItemsPerPage)
+			allPosts, err := ctx.Site.GetAllPostsInChannel(r.Context(), *c, ctx.Site.ItemsPerPage, page*ctx.Site.ItemsPerPage)
 			if err != nil {
-				http.Error(w, "couldn't retrieve posts", 500)
+				renderError(w, ctx, err)
 				return
 			}
 			ir.Posts = allPosts
@@ -536,76 +850,123 @@ func channelIndex(s *site) http.Handler {
 			if len(ir.Posts) == s.ItemsPerPage {
 				ir.HasNextPage = true
 			}
-			tmpl.Execute(w, ir)
+			render(w, ctx, tmpl, http.StatusOK, ir)
 		})
 }
 
+type registerResponse struct {
+	Error          string
+	Errors         map[string]string
+	Username       string
+	Invite         string
+	InviteRequired bool
+	siteResponse
+}
+
 func registerFormHandler(s *site) http.Handler {
 	tmpl := getTemplate("register.html")
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			ctx := siteContext{Site: s}
 			ctx.Populate(r)
-			ir := siteResponse{}
+			if !s.RegistrationOpen() {
+				errorPage(w, ctx, http.StatusForbidden, "registration is closed")
+				return
+			}
+			ir := registerResponse{
+				// links in invites fill the code in
+				Invite:         r.FormValue("invite"),
+				InviteRequired: s.Registration() == registrationInvite,
+			}
 			ctx.PopulateResponse(&ir)
-			tmpl.Execute(w, ir)
+			render(w, ctx, tmpl, http.StatusOK, ir)
 		})
 }
 
 func registerHandler(s *site) http.Handler {
+	tmpl := getTemplate("register.html")
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			if !s.AllowRegistration {
-				fmt.Fprintf(w, "registration not allowed")
-				return
-			}
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
 			username, password, pass2 := r.FormValue("username"), r.FormValue("password"), r.FormValue("pass2")
-			if password != pass2 {
-				fmt.Fprintf(w, "passwords don't match")
+			code := r.FormValue("invite")
+			user, err := s.Register(r.Context(), username, password, pass2, code)
+			if errors.Is(err, errValidation) || errors.Is(err, errConflict) {
+				ir := registerResponse{
+					Errors:         fieldErrors(err),
+					Username:       username,
+					Invite:         code,
+					InviteRequired: s.Registration() == registrationInvite,
+				}
+				if ir.Errors == nil {
+					ir.Error = errorMessage(err)
+				}
+				ctx.PopulateResponse(&ir)
+				render(w, ctx, tmpl, errorStatus(err), ir)
 				return
 			}
-			user, err := s.CreateUser(username, password)
-
 			if err != nil {
-				fmt.Println(err)
-				fmt.Fprintf(w, "could not create user")
+				renderError(w, ctx, err)
 				return
 			}
 
-			sess, _ := s.Store.Get(r, "finch")
-			sess.Values["user"] = user.Username
-			sess.Save(r, w)
+			if err := logIn(s, w, r, user.Username); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
 			http.Redirect(w, r, "/", http.StatusFound)
 		})
 }
 
+type loginResponse struct {
+	Error string
+	siteResponse
+}
+
 func loginFormHandler(s *site) http.Handler {
 	tmpl := getTemplate("login.html")
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			tmpl.Execute(w, nil)
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
+			lr := loginResponse{}
+			ctx.PopulateResponse(&lr)
+			render(w, ctx, tmpl, http.StatusOK, lr)
 		})
 }
 
 func loginHandler(s *site) http.Handler {
+	tmpl := getTemplate("login.html")
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			ctx := siteContext{Site: s}
+			ctx.Populate(r)
 			username, password := r.FormValue("username"), r.FormValue("password")
-			user, err := s.GetUser(username)
-
-			if err != nil {
-				fmt.Fprintf(w, "user not found")
+			user, err := s.Login(r.Context(), username, password, s.clientIP(r))
+			if errors.Is(err, errBadLogin) || errors.Is(err, errTooManyAttempts) || errors.Is(err, errAccountDisabled) {
+				lr := loginResponse{Error: err.Error()}
+				ctx.PopulateResponse(&lr)
+				render(w, ctx, tmpl, loginStatus(err), lr)
 				return
 			}
-			if !user.CheckPassword(password) {
-				fmt.Fprintf(w, "login failed")
+			if err != nil {
+				renderError(w, ctx, err)
 				return
 			}
 
-			// store userid in session
-			sess, _ := s.Store.Get(r, "finch")
-			sess.Values["user"] = user.Username
-			sess.Save(r, w)
+			if user.TOTPEnabled {
+				if err := awaitSecondFactor(s, w, r, user.Username); err != nil {
+					renderError(w, ctx, err)
+					return
+				}
+				http.Redirect(w, r, "/login/verify/", http.StatusFound)
+				return
+			}
+			if err := logIn(s, w, r, user.Username); err != nil {
+				renderError(w, ctx, err)
+				return
+			}
 			http.Redirect(w, r, "/", http.StatusFound)
 		})
 }
@@ -613,19 +974,43 @@ func loginHandler(s *site) http.Handler {
 func logoutHandler(s *site) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			// the whole session goes, not just who's logged in
 			sess, _ := s.Store.Get(r, "finch")
-			delete(sess.Values, "user")
+			sess.Options.MaxAge = -1
 			sess.Save(r, w)
 			http.Redirect(w, r, "/", http.StatusFound)
 		})
 }
 
-func getTemplate(filename string) *template.Template {
-	var t = template.New("base.html")
-	return template.Must(t.ParseFiles(
-		filepath.Join(templateDir, "base.html"),
-		filepath.Join(templateDir, filename),
-	))
+// page is a template along with base.html. it's parsed once, up
+// front, unless templates are being reloaded, in which case it's
+// parsed again on every render so edits show up without a restart.
+type page struct {
+	name string
+	tmpl *template.Template
+}
+
+func getTemplate(filename string) *page {
+	p := &page{name: filename}
+	if !templateReload {
+		p.tmpl = template.Must(parsePage(filename))
+	}
+	return p
+}
+
+func parsePage(filename string) (*template.Template, error) {
+	return template.New("base.html").ParseFS(templateFS, "base.html", filename)
+}
+
+func (p *page) Execute(w io.Writer, data interface{}) error {
+	t := p.tmpl
+	if t == nil {
+		var err error
+		if t, err = parsePage(p.name); err != nil {
+			return err
+		}
+	}
+	return t.Execute(w, data)
 }
 
 func healthzHandler(w http.ResponseWriter, _ *http.Request) {
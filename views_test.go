@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"html/template"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/gorilla/sessions"
 )
@@ -33,3 +41,237 @@ func TestIndexHandler(t *testing.T) {
 		t.Errorf("handler returned unexpected status code: got %v", rr.Code)
 	}
 }
+
+func TestTemplatesEscapeUserInput(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := context.Background()
+	const evil = `<script>alert("x")</script>`
+	// usernames are checked now, but accounts from before that
+	// weren't
+	u, err := s.p.CreateUser(ctx, `"><img src=x onerror=alert(1)>`, "password")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	s.UpdateProfile(ctx, *u, evil, evil)
+	channels, _ := s.AddChannels(ctx, *u, []string{evil + " news"})
+	p, _ := s.AddPost(ctx, *u, "searchable", channels)
+
+	for _, path := range []string{
+		"/",
+		"/u/" + url.PathEscape(u.Username) + "/p/" + p.UUID + "/",
+		"/u/" + url.PathEscape(u.Username) + "/",
+		"/u/" + url.PathEscape(u.Username) + "/c/" + url.PathEscape(channels[0].Slug) + "/",
+		"/search/?q=" + url.QueryEscape(evil),
+		"/search/?q=searchable",
+	} {
+		rr := apiRequest(handler, "GET", path, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200, got %d", path, rr.Code)
+			continue
+		}
+		body := rr.Body.String()
+		for _, raw := range []string{"<script>alert", "<img src=x"} {
+			if strings.Contains(body, raw) {
+				t.Errorf("GET %s: %q came through unescaped", path, raw)
+			}
+		}
+	}
+	rr := apiRequest(handler, "GET", "/search/?q="+url.QueryEscape(evil), "", nil)
+	if !strings.Contains(rr.Body.String(), "&lt;script&gt;") {
+		t.Error("expected the query to be shown escaped")
+	}
+}
+
+func TestRenderFailure(t *testing.T) {
+	s, _, cleanup := setupAPIServer(t)
+	defer cleanup()
+	ctx := siteContext{Site: s}
+	// fails part way through, after some of the page has been written
+	broken := &page{
+		name: "broken.html",
+		tmpl: template.Must(template.New("broken.html").Parse(`<p>half a page</p>{{ .Missing }}`)),
+	}
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	rr := httptest.NewRecorder()
+	render(rr, ctx, broken, http.StatusOK, struct{}{})
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rr.Code)
+	}
+	if body := rr.Body.String(); strings.Contains(body, "half a page") || !strings.Contains(body, "something went wrong") {
+		t.Errorf("expected only the error page, got %q", body)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(logged.String(), "broken.html") || !strings.Contains(logged.String(), "Missing") {
+		t.Errorf("expected the template and the error to be logged, got %q", logged.String())
+	}
+
+	working := &page{name: "fine.html", tmpl: template.Must(template.New("fine.html").Parse(`<p>{{ . }}</p>`))}
+	rr = httptest.NewRecorder()
+	render(rr, ctx, working, http.StatusTeapot, "whole")
+	if rr.Code != http.StatusTeapot || rr.Body.String() != "<p>whole</p>" {
+		t.Errorf("expected the page with its status, got %d %q", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}
+
+func TestErrorPageParsedOnce(t *testing.T) {
+	_, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+
+	// the templates going away after startup doesn't matter, the
+	// error page was parsed with the routes
+	oldFS := templateFS
+	defer func() { templateFS = oldFS }()
+	templateFS = fstest.MapFS{}
+	rr := apiRequest(handler, "GET", "/nowhere/", "", nil)
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "Not Found") {
+		t.Errorf("expected the themed 404, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// a site that never had routes added still reports errors
+	bare := siteContext{Site: &site{}}
+	rr = httptest.NewRecorder()
+	errorPage(rr, bare, http.StatusForbidden, "nope")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "nope") {
+		t.Errorf("expected a plain error, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestNotFoundPage(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	u, _ := s.CreateUser(context.Background(), "lost", "password")
+	p, _ := s.AddPost(context.Background(), *u, "still here", nil)
+
+	for _, path := range []string{
+		"/nowhere/",
+		"/u/nobody/",
+		"/u/lost/p/not-a-post/",
+		"/u/lost/c/no-channel/",
+		"/u/lost/p/" + p.UUID + "/extra/",
+	} {
+		rr := apiRequest(handler, "GET", path, "", nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404, got %d", path, rr.Code)
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("GET %s: expected an HTML page, got %q", path, ct)
+		}
+		body := rr.Body.String()
+		// the themed page, not a bare http.Error
+		if !strings.Contains(body, "Not Found") || !strings.Contains(body, `href="/media/`) {
+			t.Errorf("GET %s: expected the themed 404 page, got %q", path, body)
+		}
+	}
+
+	// the front page itself is still there
+	if rr := apiRequest(handler, "GET", "/", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("expected the index, got %d", rr.Code)
+	}
+}
+
+func TestErrorPageNegotiation(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	owner, _ := s.CreateUser(context.Background(), "owner", "password")
+	s.CreateUser(context.Background(), "other", "password")
+	p, _ := s.AddPost(context.Background(), *owner, "mine", nil)
+	cookies := loginCookies(t, handler, "other", "password")
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return serve(handler, req)
+	}
+
+	edit := "/u/owner/p/" + p.UUID + "/edit/"
+	rr := get(edit, "text/html,application/xhtml+xml,*/*;q=0.8")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "Forbidden") {
+		t.Errorf("expected the themed 403 page, got %d %q", rr.Code, rr.Body.String())
+	}
+	// logged in, so the nav shows who
+	if !strings.Contains(rr.Body.String(), `href="/u/other/"`) {
+		t.Error("expected the error page to show the logged in user")
+	}
+
+	for path, status := range map[string]int{
+		edit:        http.StatusForbidden,
+		"/nowhere/": http.StatusNotFound,
+		"/u/ghost/": http.StatusNotFound,
+	} {
+		rr := get(path, "application/json")
+		if rr.Code != status {
+			t.Errorf("GET %s: expected %d, got %d", path, status, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("GET %s: expected JSON, got %q", path, ct)
+		}
+		if !strings.HasPrefix(rr.Body.String(), `{"error":`) {
+			t.Errorf("GET %s: expected a JSON error body, got %q", path, rr.Body.String())
+		}
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                  false,
+		"*/*":                               false,
+		"text/html":                         false,
+		"application/json":                  true,
+		"application/json, text/html;q=0.5": true,
+		"text/html, application/json;q=0.9": false,
+		"application/*, text/*;q=0.1":       true,
+		"application/json;q=0, */*":         false,
+		"text/html;q=0.5, application/json": true,
+		"TEXT/HTML;Q=0.2, Application/JSON": true,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if got := wantsJSON(req); got != want {
+			t.Errorf("wantsJSON(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestFormFailuresRerender(t *testing.T) {
+	s, handler, cleanup := setupAPIServer(t)
+	defer cleanup()
+	s.CreateUser(context.Background(), "taken", "password")
+
+	for _, tc := range []struct {
+		path   string
+		form   url.Values
+		status int
+		msg    string
+	}{
+		{"/login/", url.Values{"username": {"taken"}, "password": {"wrong"}}, http.StatusUnauthorized, "invalid username or password"},
+		{"/register/", url.Values{"username": {"newbie"}, "password": {"tall ship 42"}, "pass2": {"short ship 42"}}, http.StatusUnprocessableEntity, "passwords don&#39;t match"},
+		{"/register/", url.Values{"username": {"taken"}, "password": {"tall ship 42"}, "pass2": {"tall ship 42"}}, http.StatusConflict, "taken"},
+	} {
+		resp := formRequest(handler, tc.path, tc.form, nil)
+		if resp.StatusCode != tc.status {
+			t.Errorf("POST %s %v: expected %d, got %d", tc.path, tc.form, tc.status, resp.StatusCode)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		// the form again, with what went wrong
+		if !strings.Contains(string(body), `name="username"`) || !strings.Contains(string(body), tc.msg) {
+			t.Errorf("POST %s %v: expected the form with %q, got %q", tc.path, tc.form, tc.msg, body)
+		}
+	}
+}